@@ -0,0 +1,103 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Commands by alias name. A command may consist of multiple commands
+// separated by semicolons.
+var aliases = make(map[string]string)
+
+// Nesting level of currently expanded aliases, to detect aliases using
+// themselves.
+var aliasDepth int
+
+const maxAliasDepth = 10
+
+func aliasesFile() string {
+	return filepath.Join(configDir(), "aliases")
+}
+
+// Defines an alias from a line like "alias drain = pause 3600; list". The
+// line is taken as is, so the command may contain semicolons. Without a
+// definition, all aliases are listed.
+func defineAlias(input string) error {
+	def := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(input), "alias"))
+	if def == "" {
+		return listAliases()
+	}
+	kv := strings.SplitN(def, "=", 2)
+	if len(kv) != 2 {
+		return usageError("expected alias <name> = <command>")
+	}
+	name, cmd := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+	if !isValidName(name) {
+		return usageError("invalid alias name")
+	}
+	if contains(name, commands) {
+		return usageError(fmt.Sprintf("%s is a command and can't be an alias", name))
+	}
+	if cmd == "" {
+		return usageError("no command given")
+	}
+	if _, err := parseLine(cmd); err != nil {
+		return err
+	}
+	aliases[name] = cmd
+	return saveNamed(aliasesFile(), aliases)
+}
+
+// Removes an alias.
+func removeAlias(name string) error {
+	if _, ok := aliases[name]; !ok {
+		return fmt.Errorf("unknown alias %s", name)
+	}
+	delete(aliases, name)
+	return saveNamed(aliasesFile(), aliases)
+}
+
+// Runs the commands of an alias. Arguments are appended to the last
+// command.
+func runAlias(name string, args []string) error {
+	if aliasDepth >= maxAliasDepth {
+		return fmt.Errorf("aliases nested too deeply")
+	}
+	aliasDepth++
+	defer func() { aliasDepth-- }()
+
+	input := aliases[name]
+	if len(args) > 0 {
+		input += " " + formatArgs(args)
+	}
+	return execLine(input)
+}
+
+// Checks if a line defines an alias. These lines must not be split at
+// semicolons.
+func isAliasDefinition(input string) bool {
+	f := strings.Fields(input)
+	return len(f) > 0 && f[0] == "alias"
+}
+
+func listAliases() error {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rs []*record
+	for _, name := range names {
+		rs = append(rs, newRecord().set("alias", name).set("command", aliases[name]))
+	}
+	return renderTable(rs)
+}
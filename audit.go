@@ -0,0 +1,200 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// A command changing jobs or tubes, as recorded in the audit log.
+type auditEntry struct {
+	TS      time.Time    `json:"ts"`
+	User    string       `json:"user"`
+	Server  string       `json:"server"`
+	Command string       `json:"command"`
+	Tubes   []string     `json:"tubes"`
+	Jobs    []auditedJob `json:"jobs"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// A job affected by a command. Instead of the body, which may contain
+// sensitive data, we keep its hash.
+type auditedJob struct {
+	Action string `json:"action"`
+	Server string `json:"server,omitempty"` // Only when connected to multiple servers.
+	ID     uint64 `json:"id"`
+	Tube   string `json:"tube"`
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	auditLog string      // Path to the audit log.
+	cAudit   *auditEntry // Entry of the currently running command, if audited.
+)
+
+// Returns the default location of the audit log.
+func defaultAuditLog() string {
+	return filepath.Join(stateDir(), "audit.log")
+}
+
+// Starts recording a command. Fails if the audit log isn't writable, so
+// that no command goes unrecorded.
+func beginAudit(args []string) error {
+	if err := os.MkdirAll(filepath.Dir(auditLog), 0700); err != nil {
+		return fmt.Errorf("failed to create audit log: %s", err)
+	}
+	f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+	f.Close()
+
+	cAudit = &auditEntry{
+		TS:      time.Now().UTC(),
+		User:    osUser(),
+		Server:  addr,
+		Command: formatArgs(args),
+		Tubes:   []string{},
+		Jobs:    []auditedJob{},
+	}
+	return nil
+}
+
+// Finishes recording the current command and appends it to the audit log.
+func endAudit(err error) {
+	e := cAudit
+	cAudit = nil
+
+	if e == nil {
+		return
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	data, merr := json.Marshal(e)
+	if merr != nil {
+		printError(fmt.Errorf("failed to write audit log: %s", merr))
+		return
+	}
+	f, ferr := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if ferr != nil {
+		printError(fmt.Errorf("failed to write audit log: %s", ferr))
+		return
+	}
+	defer f.Close()
+
+	if _, werr := f.Write(append(data, '\n')); werr != nil {
+		printError(fmt.Errorf("failed to write audit log: %s", werr))
+	}
+}
+
+// Records a tube affected by the current command.
+func auditTube(name string) {
+	if cAudit != nil && !contains(name, cAudit.Tubes) {
+		cAudit.Tubes = append(cAudit.Tubes, name)
+	}
+}
+
+// Records a job affected by the current command, action is what has been
+// done to it, i.e. deleted or kicked.
+func auditJob(action string, c *beanstalk.Conn, id uint64, tube string, body []byte) {
+	if cAudit == nil {
+		return
+	}
+	sum := sha256.Sum256(body)
+
+	aj := auditedJob{Action: action, ID: id, Tube: tube, SHA256: hex.EncodeToString(sum[:])}
+	if s := serverOf(c); s != nil && len(servers) > 1 {
+		aj.Server = s.addr
+	}
+	cAudit.Jobs = append(cAudit.Jobs, aj)
+	auditTube(tube)
+}
+
+// Returns the name of the user running us.
+func osUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Joins arguments to a command line, quoting arguments where needed so
+// parseLine returns them unchanged.
+func formatArgs(args []string) string {
+	qs := make([]string, len(args))
+
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\"';") {
+			// parseLine has no escapes, but joins quoted parts, so single
+			// quotes are written as '"'"'.
+			a = "'" + strings.Replace(a, "'", `'"'"'`, -1) + "'"
+		}
+		qs[i] = a
+	}
+	return strings.Join(qs, " ")
+}
+
+// Shows the most recent entries of the audit log.
+func auditHistory(args []string) error {
+	fs := flag.NewFlagSet("history audit", flag.ContinueOnError)
+	count := fs.Int("n", 20, "number of entries")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	f, err := os.Open(auditLog)
+	if os.IsNotExist(err) {
+		return renderTable(nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var es []auditEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1<<30)
+
+	for n := 1; s.Scan(); n++ {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %s", auditLog, n, err)
+		}
+		es = append(es, e)
+		if *count > 0 && len(es) > *count {
+			es = es[1:]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	var rs []*record
+	for _, e := range es {
+		rs = append(rs, newRecord().
+			set("ts", e.TS.Local().Format("2006-01-02 15:04:05")).
+			set("user", e.User).
+			set("server", e.Server).
+			set("command", e.Command).
+			set("tubes", strings.Join(e.Tubes, ",")).
+			set("jobs", len(e.Jobs)).
+			set("error", e.Error))
+	}
+	return renderTable(rs)
+}
@@ -0,0 +1,189 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Default address of the beanstalkd server.
+const defaultAddr = "127.0.0.1:11300"
+
+// A named set of connection settings, as read from the config file.
+type profile struct {
+	name     string
+	addr     string
+	tubes    []string // Tubes selected after connecting, all if empty.
+	readonly bool     // Refuse commands changing jobs or tubes.
+}
+
+var (
+	profiles = make(map[string]*profile) // Profiles by name.
+	cProfile *profile                    // Profile of the current connection.
+)
+
+// Returns the directory holding our configuration, following the XDG
+// base directory specification.
+func configDir() string {
+	if d := os.Getenv("XDG_CONFIG_HOME"); d != "" {
+		return filepath.Join(d, "bsa")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "bsa")
+}
+
+// Returns the directory for data we keep across sessions, like the audit
+// log, following the XDG base directory specification.
+func stateDir() string {
+	if d := os.Getenv("XDG_STATE_HOME"); d != "" {
+		return filepath.Join(d, "bsa")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".local", "state", "bsa")
+}
+
+// Reads profiles from an INI style config file. Each section is a profile,
+// i.e.:
+//
+//	[prod-eu]
+//	addr = 10.0.0.5:11300
+//	default_tubes = emails billing
+//
+// A missing config file is not an error.
+func loadConfig(file string) (map[string]*profile, error) {
+	ps := make(map[string]*profile)
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p *profile
+	s := bufio.NewScanner(f)
+	n := 0
+
+	for s.Scan() {
+		n++
+		l := strings.TrimSpace(s.Text())
+
+		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";") {
+			continue
+		}
+		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
+			name := strings.TrimSpace(l[1 : len(l)-1])
+			p = &profile{name: name, addr: defaultAddr}
+			ps[name] = p
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || p == nil {
+			return nil, fmt.Errorf("%s:%d: expected a section or key = value", file, n)
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch k {
+		case "addr":
+			p.addr = v
+		case "default_tubes":
+			p.tubes = strings.FieldsFunc(v, func(r rune) bool {
+				return r == ',' || r == ' '
+			})
+		case "readonly":
+			p.readonly = v == "true" || v == "yes" || v == "1"
+		}
+	}
+	return ps, s.Err()
+}
+
+// Returns the name of the current connection, for use in the prompt.
+func connName() string {
+	if cProfile.name != "" {
+		return cProfile.name
+	}
+	if cProfile.addr == defaultAddr {
+		return "beanstalkd"
+	}
+	return cProfile.addr
+}
+
+// Reads a file of named values, one "name = value" per line. Empty lines
+// and lines starting with # are skipped. A missing file is not an error.
+func loadNamed(file string) (map[string]string, error) {
+	vs := make(map[string]string)
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return vs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	n := 0
+
+	for s.Scan() {
+		n++
+		l := strings.TrimSpace(s.Text())
+
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", file, n)
+		}
+		vs[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return vs, s.Err()
+}
+
+// Writes named values sorted by name, replacing the file. Creates the
+// config directory if needed.
+func saveNamed(file string, vs map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(vs))
+	for name := range vs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s = %s\n", name, vs[name])
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Checks if a name is usable for groups, aliases and snapshots.
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,585 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A decoder turns a job body into something readable. Decoders either
+// render the body or unwrap it, in which case the unwrapped body is
+// decoded again, i.e. gzip compressed JSON.
+type decoder struct {
+	name   string
+	decode func(body []byte) (out []byte, unwrapped bool, err error)
+}
+
+// Decoders in the order they are tried, when detecting the format of a
+// body. The first one succeeding wins.
+var decoders = []decoder{
+	{"gzip", decodeGzip},
+	{"zlib", decodeZlib},
+	{"json", decodeJSON},
+	{"php", decodePHP},
+	{"msgpack", decodeMsgpack},
+	{"text", decodeText},
+	{"hex", decodeHex},
+}
+
+// Decoders which can only be selected explicitly.
+var extraDecoders = []decoder{
+	{"raw", func(b []byte) ([]byte, bool, error) { return b, false, nil }},
+}
+
+// Name of the decoder used for job bodies, auto detects the format if
+// empty.
+var bodyDecoder string
+
+// Returns names of all decoders, for help and errors.
+func decoderNames() []string {
+	names := []string{"auto"}
+	for _, d := range append(extraDecoders, decoders...) {
+		names = append(names, d.name)
+	}
+	return names
+}
+
+// Returns a usage error for unknown decoders.
+func checkDecoder(name string) error {
+	if name == "" || name == "auto" {
+		return nil
+	}
+	if _, ok := findDecoder(name); !ok {
+		return usageError(fmt.Sprintf("unknown decoder, must be one of: %s", strings.Join(decoderNames(), ", ")))
+	}
+	return nil
+}
+
+func findDecoder(name string) (decoder, bool) {
+	for _, d := range append(extraDecoders, decoders...) {
+		if d.name == name {
+			return d, true
+		}
+	}
+	return decoder{}, false
+}
+
+// Renders a body with given decoder, or the first one succeeding if name
+// is empty or auto. Returns the rendered body along with the names of the
+// decoders used.
+func decodeBody(body []byte, name string) ([]byte, []string, error) {
+	if name != "" && name != "auto" {
+		if err := checkDecoder(name); err != nil {
+			return nil, nil, err
+		}
+		d, _ := findDecoder(name)
+		out, unwrapped, err := d.decode(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("not %s: %s", d.name, err)
+		}
+		if unwrapped {
+			out, used, err := decodeBody(out, "")
+			return out, append([]string{d.name}, used...), err
+		}
+		return out, []string{d.name}, nil
+	}
+	for _, d := range decoders {
+		out, unwrapped, err := d.decode(body)
+		if err != nil {
+			continue
+		}
+		if unwrapped {
+			out, used, err := decodeBody(out, "")
+			return out, append([]string{d.name}, used...), err
+		}
+		return out, []string{d.name}, nil
+	}
+	// Not reached, as the hex decoder never fails.
+	return body, nil, nil
+}
+
+func decodeGzip(b []byte) ([]byte, bool, error) {
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return nil, false, errors.New("missing gzip header")
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, false, err
+	}
+	out, err := ioutil.ReadAll(r)
+	return out, true, err
+}
+
+func decodeZlib(b []byte) ([]byte, bool, error) {
+	if len(b) < 2 || b[0]&0x0f != 8 || (uint16(b[0])<<8|uint16(b[1]))%31 != 0 {
+		return nil, false, errors.New("missing zlib header")
+	}
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, false, err
+	}
+	out, err := ioutil.ReadAll(r)
+	return out, true, err
+}
+
+// Pretty prints JSON objects and arrays, colorized when writing to a
+// terminal.
+func decodeJSON(b []byte) ([]byte, bool, error) {
+	t := bytes.TrimSpace(b)
+	if len(t) == 0 || (t[0] != '{' && t[0] != '[') {
+		return nil, false, errors.New("neither an object nor an array")
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, t, "", "  "); err != nil {
+		return nil, false, err
+	}
+	return colorizeJSON(buf.Bytes()), false, nil
+}
+
+// Renders a decoded value as JSON, used by decoders of other formats.
+func renderValue(v interface{}) ([]byte, bool, error) {
+	var buf bytes.Buffer
+
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "  ")
+	if err := e.Encode(v); err != nil {
+		return nil, false, err
+	}
+	return colorizeJSON(bytes.TrimRight(buf.Bytes(), "\n")), false, nil
+}
+
+// Passes through text, which doesn't contain control characters that
+// could mess up the terminal.
+func decodeText(b []byte) ([]byte, bool, error) {
+	if !utf8.Valid(b) {
+		return nil, false, errors.New("invalid UTF-8")
+	}
+	for _, c := range b {
+		if (c < 0x20 && c != '\t' && c != '\n' && c != '\r') || c == 0x7f {
+			return nil, false, errors.New("contains control characters")
+		}
+	}
+	return b, false, nil
+}
+
+func decodeHex(b []byte) ([]byte, bool, error) {
+	return bytes.TrimRight([]byte(hex.Dump(b)), "\n"), false, nil
+}
+
+// Checks if we should use colors, which is only the case when writing to
+// a terminal, that hasn't opted out.
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" || format != "text" {
+		return false
+	}
+	return isTerminalFile(os.Stdout)
+}
+
+// Colors for parts of JSON documents.
+const (
+	colorKey     = "\033[34m"
+	colorString  = "\033[32m"
+	colorNumber  = "\033[36m"
+	colorLiteral = "\033[35m"
+	colorReset   = "\033[0m"
+)
+
+// Adds terminal colors to indented JSON.
+func colorizeJSON(b []byte) []byte {
+	if !useColor() {
+		return b
+	}
+	var out bytes.Buffer
+
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == '"':
+			j := i + 1
+			for j < len(b) && b[j] != '"' {
+				if b[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j++
+			if j > len(b) {
+				j = len(b)
+			}
+			color := colorString
+			if j < len(b) && b[j] == ':' {
+				color = colorKey
+			}
+			out.WriteString(color)
+			out.Write(b[i:j])
+			out.WriteString(colorReset)
+			i = j
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i
+			for j < len(b) && strings.IndexByte("+-.eE0123456789", b[j]) >= 0 {
+				j++
+			}
+			out.WriteString(colorNumber)
+			out.Write(b[i:j])
+			out.WriteString(colorReset)
+			i = j
+		case c == 't' || c == 'f' || c == 'n':
+			j := i
+			for j < len(b) && b[j] >= 'a' && b[j] <= 'z' {
+				j++
+			}
+			out.WriteString(colorLiteral)
+			out.Write(b[i:j])
+			out.WriteString(colorReset)
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// Decodes a value created by PHP's serialize(). Arrays with keys 0 to n-1
+// become lists, all other arrays and objects keep the order of their
+// keys. The class name of objects is kept in a __class key.
+func decodePHP(b []byte) ([]byte, bool, error) {
+	p := &phpParser{b: b}
+	v, err := p.value()
+	if err != nil {
+		return nil, false, err
+	}
+	if p.i != len(b) {
+		return nil, false, errors.New("trailing data")
+	}
+	return renderValue(v)
+}
+
+type phpParser struct {
+	b []byte
+	i int
+}
+
+func (p *phpParser) expect(c byte) error {
+	if p.i >= len(p.b) || p.b[p.i] != c {
+		return fmt.Errorf("expected %q at offset %d", c, p.i)
+	}
+	p.i++
+	return nil
+}
+
+// Reads up to the given delimiter, which is consumed.
+func (p *phpParser) until(c byte) (string, error) {
+	j := bytes.IndexByte(p.b[p.i:], c)
+	if j < 0 {
+		return "", fmt.Errorf("expected %q after offset %d", c, p.i)
+	}
+	s := string(p.b[p.i : p.i+j])
+	p.i += j + 1
+	return s, nil
+}
+
+func (p *phpParser) value() (interface{}, error) {
+	if p.i+1 >= len(p.b) {
+		return nil, errors.New("unexpected end")
+	}
+	t := p.b[p.i]
+	p.i++
+
+	if t == 'N' {
+		return nil, p.expect(';')
+	}
+	if err := p.expect(':'); err != nil {
+		return nil, err
+	}
+	switch t {
+	case 'b':
+		s, err := p.until(';')
+		return s == "1", err
+	case 'i':
+		s, err := p.until(';')
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case 'd':
+		s, err := p.until(';')
+		if err != nil {
+			return nil, err
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return s, err
+		}
+		return f, err
+	case 's':
+		return p.str(';')
+	case 'a':
+		return p.array("")
+	case 'O':
+		class, err := p.str(':')
+		if err != nil {
+			return nil, err
+		}
+		return p.array(class)
+	case 'r', 'R':
+		s, err := p.until(';')
+		return "reference to #" + s, err
+	}
+	return nil, fmt.Errorf("unknown type %q", t)
+}
+
+// Reads a length prefixed, quoted string followed by given terminator.
+func (p *phpParser) str(term byte) (string, error) {
+	ls, err := p.until(':')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(ls)
+	if err != nil || n < 0 || n > len(p.b)-p.i-2 {
+		return "", errors.New("invalid string length")
+	}
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+	s := string(p.b[p.i : p.i+n])
+	p.i += n
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+	return s, p.expect(term)
+}
+
+func (p *phpParser) array(class string) (interface{}, error) {
+	ns, err := p.until(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(ns)
+	if err != nil || n < 0 {
+		return nil, errors.New("invalid array length")
+	}
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	r := newRecord()
+	if class != "" {
+		r.set("__class", class)
+	}
+	list := class == ""
+
+	for i := 0; i < n; i++ {
+		k, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if ki, ok := k.(int64); !ok || ki != int64(i) {
+			list = false
+		}
+		r.set(fmt.Sprint(k), v)
+	}
+	if err := p.expect('}'); err != nil {
+		return nil, err
+	}
+	if list {
+		l := make([]interface{}, 0, n)
+		for _, k := range r.keys {
+			l = append(l, r.get(k))
+		}
+		return l, nil
+	}
+	return r, nil
+}
+
+// Decodes MessagePack. Only bodies starting with a map or an array are
+// detected, as most payloads are one of these and other types are easily
+// mistaken for binary data.
+func decodeMsgpack(b []byte) ([]byte, bool, error) {
+	if len(b) == 0 || !(b[0] >= 0x80 && b[0] <= 0x9f || b[0] >= 0xdc && b[0] <= 0xdf) {
+		return nil, false, errors.New("neither a map nor an array")
+	}
+	p := &msgpackParser{b: b}
+	v, err := p.value()
+	if err != nil {
+		return nil, false, err
+	}
+	if p.i != len(b) {
+		return nil, false, errors.New("trailing data")
+	}
+	return renderValue(v)
+}
+
+type msgpackParser struct {
+	b []byte
+	i int
+}
+
+func (p *msgpackParser) next(n int) ([]byte, error) {
+	if n < 0 || n > len(p.b)-p.i {
+		return nil, errors.New("unexpected end")
+	}
+	r := p.b[p.i : p.i+n]
+	p.i += n
+	return r, nil
+}
+
+// Reads an unsigned big endian integer of n bytes.
+func (p *msgpackParser) uint(n int) (uint64, error) {
+	b, err := p.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (p *msgpackParser) value() (interface{}, error) {
+	t, err := p.uint(1)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t <= 0x7f:
+		return t, nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t >= 0x80 && t <= 0x8f:
+		return p.mapOf(int(t & 0x0f))
+	case t >= 0x90 && t <= 0x9f:
+		return p.arrayOf(int(t & 0x0f))
+	case t >= 0xa0 && t <= 0xbf:
+		return p.str(int(t & 0x1f))
+	}
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := p.uint(1 << (t - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := p.next(int(n))
+		return plainValue(b), err
+	case 0xc7, 0xc8, 0xc9:
+		n, err := p.uint(1 << (t - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return p.ext(int(n))
+	case 0xca:
+		v, err := p.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := p.uint(8)
+		f := math.Float64frombits(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Sprint(f), err
+		}
+		return f, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return p.uint(1 << (t - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (t - 0xd0)
+		v, err := p.uint(n)
+		// Sign extend.
+		shift := uint(64 - 8*n)
+		return int64(v<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return p.ext(1 << (t - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := p.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return p.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := p.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return p.arrayOf(int(n))
+	case 0xde, 0xdf:
+		n, err := p.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return p.mapOf(int(n))
+	}
+	return nil, fmt.Errorf("unknown type 0x%x", t)
+}
+
+func (p *msgpackParser) str(n int) (interface{}, error) {
+	b, err := p.next(n)
+	return plainValue(b), err
+}
+
+// Extension types are application specific, we show their type and data.
+func (p *msgpackParser) ext(n int) (interface{}, error) {
+	t, err := p.next(1)
+	if err != nil {
+		return nil, err
+	}
+	b, err := p.next(n)
+	return newRecord().set("ext", int8(t[0])).set("data", hex.EncodeToString(b)), err
+}
+
+func (p *msgpackParser) arrayOf(n int) (interface{}, error) {
+	if n > len(p.b)-p.i {
+		return nil, errors.New("invalid array length")
+	}
+	l := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+	return l, nil
+}
+
+func (p *msgpackParser) mapOf(n int) (interface{}, error) {
+	if n > len(p.b)-p.i {
+		return nil, errors.New("invalid map length")
+	}
+	r := newRecord()
+	for i := 0; i < n; i++ {
+		k, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		r.set(fmt.Sprint(k), v)
+	}
+	return r, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeBodyMalformed(t *testing.T) {
+	gz := gzipped([]byte(`{"a": 1}`))
+
+	tests := []struct {
+		body []byte
+		used []string
+	}{
+		{[]byte(`a:2:{i:0;s:1:"a";i:1;s:1:"b";}`), []string{"php"}},
+		{[]byte(`s:9223372036854775807:"x";`), []string{"text"}},
+		{[]byte(`s:-1:"x";`), []string{"text"}},
+		{[]byte(`s:5:"x";`), []string{"text"}},
+		{[]byte(`a:2:{i:0;s:1:"a";`), []string{"text"}},
+		{[]byte(`a:9223372036854775807:{}`), []string{"text"}},
+		{[]byte(`O:3:"Foo":1:{s:1:"a";}`), []string{"text"}},
+		{[]byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0xc3}, []string{"msgpack"}},
+		{[]byte{0x92, 0x01}, []string{"hex"}},
+		{[]byte{0x91, 0xdb, 0xff, 0xff, 0xff, 0xff, 'x'}, []string{"hex"}},
+		{[]byte{0x91, 0xc6, 0xff, 0xff, 0xff, 0xff}, []string{"hex"}},
+		{[]byte{0xdf, 0xff, 0xff, 0xff, 0xff}, []string{"hex"}},
+		{[]byte{0x81, 0xd8}, []string{"hex"}},
+		{gz, []string{"gzip", "json"}},
+		{gz[:len(gz)-6], []string{"hex"}},
+		{[]byte{0x1f, 0x8b}, []string{"hex"}},
+		{[]byte{0x1f, 0x8b, 0x08, 0x00, 'j', 'u', 'n', 'k'}, []string{"hex"}},
+		{gzipped([]byte(`s:9223372036854775807:"x";`)), []string{"gzip", "text"}},
+	}
+	for _, test := range tests {
+		_, used, err := decodeBody(test.body, "")
+		if err != nil {
+			t.Errorf("decodeBody(%q) failed: %s", test.body, err)
+			continue
+		}
+		if !reflect.DeepEqual(used, test.used) {
+			t.Errorf("decodeBody(%q) used %v, want %v", test.body, used, test.used)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// Commands supporting the --dry-run modifier.
+var dryRunCommands = []string{"clear", "kick", "pause"}
+
+// Set by 'set dryrun on', makes all commands supporting it run dry.
+var dryRun bool
+
+// Removes the --dry-run modifier from a command's arguments and reports
+// whether it was present.
+func stripDryRun(args []string) ([]string, bool) {
+	var r []string
+	found := false
+
+	for _, a := range args {
+		if a == "--dry-run" || a == "-dry-run" {
+			found = true
+			continue
+		}
+		r = append(r, a)
+	}
+	return r, found
+}
+
+// Adds the next job in given state of a tube to its record, so one can
+// see what kind of jobs would be affected. Only the start of its body is
+// shown, cleaned up like grep snippets.
+func sampleJob(t beanstalk.Tube, state string, r *record) error {
+	id, body, err := peekState(t, state)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+	}
+	r.set("sample", id).set("body", snippet(body, 0, 0))
+	return nil
+}
+
+// Shows how many jobs clear would delete from each selected tube.
+func dryClearTubes(state string) error {
+	if !contains(state, states) {
+		return usageError("unknown state")
+	}
+	return eachTube(func(t beanstalk.Tube, r *record) error {
+		stats, err := t.Stats()
+		if err != nil {
+			return fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		r.set("state", state).set("would delete", castStatsValue(stats["current-jobs-"+state]))
+		return sampleJob(t, state, r)
+	})
+}
+
+// Shows how many jobs kick would kick in each selected tube. Like the
+// server, buried jobs are kicked, or delayed ones if there are none.
+func dryKickTubes(bound int) error {
+	return eachTube(func(t beanstalk.Tube, r *record) error {
+		stats, err := t.Stats()
+		if err != nil {
+			return fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		state := "buried"
+		n := castStatsValue(stats["current-jobs-buried"])
+		if n == 0 {
+			state = "delayed"
+			n = castStatsValue(stats["current-jobs-delayed"])
+		}
+		if n > bound {
+			n = bound
+		}
+		r.set("state", state).set("would kick", n)
+		return sampleJob(t, state, r)
+	})
+}
+
+// Shows which tubes pause would pause and for how long they are paused
+// already.
+func dryPauseTubes(delay time.Duration) error {
+	return eachTube(func(t beanstalk.Tube, r *record) error {
+		stats, err := t.Stats()
+		if err != nil {
+			return fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		r.set("paused", castStatsValue(stats["pause-time-left"])).set("would pause", int(delay.Seconds()))
+		return nil
+	})
+}
+
+// Changes a session setting, shows all settings if none is given.
+func set(args []string) error {
+	if len(args) == 0 {
+		decoder := bodyDecoder
+		if decoder == "" {
+			decoder = "auto"
+		}
+		return renderDetail(newRecord().set("dryrun", onOff(dryRun)).set("decoder", decoder))
+	}
+	if len(args) < 2 {
+		return usageError("no value given")
+	}
+	switch args[0] {
+	case "dryrun":
+		switch args[1] {
+		case "on":
+			dryRun = true
+		case "off":
+			dryRun = false
+		default:
+			return usageError("value must be either on or off")
+		}
+	case "decoder":
+		if err := checkDecoder(args[1]); err != nil {
+			return err
+		}
+		bodyDecoder = args[1]
+	default:
+		return usageError("unknown setting")
+	}
+	return nil
+}
+
+func onOff(v bool) string {
+	if v {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,223 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kr/beanstalk"
+)
+
+// A job as stored in a dump, one per line.
+type dumpedJob struct {
+	ID       uint64 `json:"id"`
+	Tube     string `json:"tube"`
+	State    string `json:"state"`
+	Pri      uint32 `json:"pri"`
+	TTR      int    `json:"ttr"`
+	Delay    int    `json:"delay"` // Remaining delay in seconds.
+	Body     string `json:"body"`
+	Encoding string `json:"encoding,omitempty"` // Either empty or base64.
+}
+
+func newDumpedJob(j *job) dumpedJob {
+	d := dumpedJob{
+		ID:    j.id,
+		Tube:  j.tube(),
+		State: j.state(),
+		Pri:   j.pri(),
+		TTR:   int(j.ttr().Seconds()),
+		Delay: int(j.delay().Seconds()),
+	}
+	if utf8.Valid(j.body) {
+		d.Body = string(j.body)
+	} else {
+		d.Body = base64.StdEncoding.EncodeToString(j.body)
+		d.Encoding = "base64"
+	}
+	return d
+}
+
+func (d dumpedJob) body() ([]byte, error) {
+	if d.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(d.Body)
+	}
+	return []byte(d.Body), nil
+}
+
+// Parses the arguments of dump: <state> <file> [-move]. Also used to
+// decide whether dump deletes jobs, so this must be the only place
+// parsing them.
+func parseDumpArgs(args []string) (state, file string, move bool, err error) {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	m := fs.Bool("move", false, "delete jobs once dumped")
+
+	rest, err := parseInterspersedFlags(fs, args)
+	if err != nil {
+		return "", "", false, err
+	}
+	if len(rest) < 2 {
+		return "", "", false, usageError("no state or file given")
+	}
+	return rest[0], rest[1], *m, nil
+}
+
+// Writes all jobs in given state in selected tubes to a file, as JSON
+// Lines. When moving, jobs are deleted once they have been written.
+func dumpJobs(state, file string, move bool) error {
+	if !contains(state, states) {
+		return usageError("unknown state")
+	}
+	if move {
+		if err := confirmState("dump and delete", state, 0, ""); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	e := json.NewEncoder(w)
+	counts := make(map[string]int)
+
+	write := func(j *job) error {
+		if err := e.Encode(newDumpedJob(j)); err != nil {
+			return err
+		}
+		counts[j.tube()]++
+		return nil
+	}
+	if move {
+		err = moveOut(state, func(j *job) error {
+			if err := write(j); err != nil {
+				return err
+			}
+			// Make sure the job is persisted, before deleting it.
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			return f.Sync()
+		})
+	} else {
+		err = walkJobs(state, write)
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+
+	var rs []*record
+	for _, tn := range cTubes.Names {
+		rs = append(rs, newRecord().set("tube", tn).set("state", state).set("dumped", counts[tn]))
+	}
+	renderTable(rs)
+	return err
+}
+
+// Calls fn for the head job in given state of each selected tube and
+// deletes the job afterwards, until no more jobs are left. Uses the same
+// peek and delete loop as clearTubes. Stops with errInterrupted, once
+// interrupted.
+func moveOut(state string, fn func(j *job) error) error {
+	for _, t := range cTubes.Conns {
+		for {
+			if interrupted() {
+				return errInterrupted
+			}
+			id, body, err := peekState(t, state)
+			if isNotFound(err) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+			}
+			stats, err := t.Conn.StatsJob(id)
+			if isNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to get stats of job %d: %s", id, err)
+			}
+			if err := fn(&job{t.Conn, id, body, stats}); err != nil {
+				return err
+			}
+			if err := t.Conn.Delete(id); err != nil {
+				return fmt.Errorf("job %d has been copied but not deleted: %s", id, jobFailure(t.Conn, id, err))
+			}
+			auditJob("deleted", t.Conn, id, t.Name, body)
+		}
+	}
+	return nil
+}
+
+// Puts jobs from a dump file, keeping priority, TTR and remaining delay.
+// Jobs are put into their original tube, unless tube is given. Buried jobs
+// are restored as ready jobs.
+func restoreJobs(file, tube string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1<<30)
+
+	counts := make(map[string]int)
+	var tns []string
+	n := 0
+
+	for s.Scan() {
+		n++
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var d dumpedJob
+		if err := json.Unmarshal(s.Bytes(), &d); err != nil {
+			err = fmt.Errorf("%s:%d: %s", file, n, err)
+			break
+		}
+		body, derr := d.body()
+		if derr != nil {
+			err = fmt.Errorf("%s:%d: %s", file, n, derr)
+			break
+		}
+		if tube != "" {
+			d.Tube = tube
+		}
+		t := beanstalk.Tube{Conn: conn, Name: d.Tube}
+
+		id, perr := t.Put(body, d.Pri, time.Duration(d.Delay)*time.Second, time.Duration(d.TTR)*time.Second)
+		if perr != nil {
+			err = fmt.Errorf("%s:%d: failed to put job %d: %s", file, n, d.ID, perr)
+			break
+		}
+		auditJob("put", conn, id, d.Tube, body)
+		if !contains(d.Tube, tns) {
+			tns = append(tns, d.Tube)
+		}
+		counts[d.Tube]++
+	}
+	if serr := s.Err(); err == nil {
+		err = serr
+	}
+
+	var rs []*record
+	for _, tn := range tns {
+		rs = append(rs, newRecord().set("tube", tn).set("restored", counts[tn]))
+	}
+	renderTable(rs)
+	return err
+}
@@ -0,0 +1,277 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// Timeout for connecting to and talking with the server during a scrape.
+const exporterTimeout = 5 * time.Second
+
+// Serves server and tube statistics as Prometheus metrics. Uses its own
+// connections, which are reestablished on the next scrape after they
+// failed, so the exporter survives restarts of the servers.
+type exporter struct {
+	sync.Mutex
+	targets []*target
+}
+
+// A server scraped by the exporter. When scraping multiple servers, their
+// samples carry a server label.
+type target struct {
+	addr   string
+	labels map[string]string
+	nc     io.ReadWriteCloser
+	conn   *beanstalk.Conn
+}
+
+// Server statistics with string values, exported as labels of the info
+// metric. Some may look like numbers, i.e. version 1.10.
+var infoKeys = []string{"version", "id", "hostname", "os", "platform", "draining"}
+
+// A metric with all its samples.
+type metric struct {
+	help    string
+	kind    string // Either counter or gauge.
+	samples []string
+}
+
+// Runs the exporter until it fails, arguments are flags for the exporter.
+func runExporter(args []string) error {
+	fs := flag.NewFlagSet("exporter", flag.ContinueOnError)
+	listen := fs.String("listen", ":9127", "address to listen on")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	e := &exporter{}
+	as := splitAddrs(addr)
+	for _, a := range as {
+		t := &target{addr: a}
+		if len(as) > 1 {
+			t.labels = map[string]string{"server": a}
+		}
+		e.targets = append(e.targets, t)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><body><a href=\"/metrics\">Metrics</a></body></html>\n")
+	})
+	fmt.Fprintf(os.Stderr, "Serving metrics of %s on %s/metrics\n", addr, *listen)
+
+	return http.ListenAndServe(*listen, mux)
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+
+	start := time.Now()
+	ms := make(map[string]*metric)
+
+	for _, t := range e.targets {
+		// Retry once with a new connection, the server may have been
+		// restarted since the last scrape. Samples are only added once
+		// collecting succeeded, to not report partial results.
+		tms := make(map[string]*metric)
+		err := t.collect(tms)
+		if err != nil {
+			t.close()
+			tms = make(map[string]*metric)
+			err = t.collect(tms)
+		}
+		up := 1
+		if err != nil {
+			t.close()
+			fmt.Fprintf(os.Stderr, "Error: failed to collect metrics of %s: %s.\n", t.addr, err)
+			up = 0
+		} else {
+			mergeMetrics(ms, tms)
+		}
+		addSample(ms, "beanstalkd_up", "gauge", "Whether the server could be reached.", t.labels, float64(up))
+	}
+	addSample(ms, "bsa_scrape_duration_seconds", "gauge", "Time it took to collect metrics.", nil, time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(formatMetrics(ms))
+}
+
+func (t *target) close() {
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.nc, t.conn = nil, nil
+}
+
+// Collects server and tube statistics into metrics.
+func (t *target) collect(ms map[string]*metric) error {
+	if t.conn == nil {
+		nc, err := dialAddr(t.addr, exporterTimeout)
+		if err != nil {
+			return err
+		}
+		t.nc, t.conn = nc, beanstalk.NewConn(nc)
+	}
+	if nc, ok := t.nc.(net.Conn); ok {
+		nc.SetDeadline(time.Now().Add(exporterTimeout))
+	}
+
+	stats, err := t.conn.Stats()
+	if err != nil {
+		return err
+	}
+	info := withLabels(t.labels, nil)
+
+	for k, v := range stats {
+		if contains(k, infoKeys) {
+			info[k] = v
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		name, kind := metricName("beanstalkd_", k)
+		addSample(ms, name, kind, fmt.Sprintf("Value of %s in server statistics.", k), t.labels, f)
+	}
+	addSample(ms, "beanstalkd_info", "gauge", "Information about the server.", info, 1)
+
+	tns, err := t.conn.ListTubes()
+	if err != nil {
+		return err
+	}
+	for _, tn := range tns {
+		tube := beanstalk.Tube{Conn: t.conn, Name: tn}
+
+		stats, err := tube.Stats()
+		if isNotFound(err) {
+			// The tube has gone away since listing it.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for k, v := range stats {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			name, kind := metricName("beanstalkd_tube_", k)
+			addSample(ms, name, kind, fmt.Sprintf("Value of %s in tube statistics.", k), withLabels(t.labels, map[string]string{"tube": tn}), f)
+		}
+	}
+	return nil
+}
+
+// Derives metric name and type from a statistics key. Command and total
+// counts are counters, everything else is a gauge.
+func metricName(prefix, k string) (name string, kind string) {
+	name = strings.Replace(k, "-", "_", -1)
+	kind = "gauge"
+
+	switch {
+	case strings.HasPrefix(k, "total-"):
+		name = strings.TrimPrefix(name, "total_") + "_total"
+		kind = "counter"
+	case strings.HasPrefix(k, "cmd-"), k == "job-timeouts", strings.HasPrefix(k, "binlog-records-"):
+		name += "_total"
+		kind = "counter"
+	case strings.HasPrefix(k, "rusage-"):
+		name += "_seconds_total"
+		kind = "counter"
+	case k == "uptime", k == "pause", k == "pause-time-left":
+		name += "_seconds"
+	}
+	return prefix + name, kind
+}
+
+// Returns a new set of labels, containing both given sets.
+func withLabels(a, b map[string]string) map[string]string {
+	ls := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		ls[k] = v
+	}
+	for k, v := range b {
+		ls[k] = v
+	}
+	return ls
+}
+
+// Adds all samples of src to dst.
+func mergeMetrics(dst, src map[string]*metric) {
+	for name, m := range src {
+		if d, ok := dst[name]; ok {
+			d.samples = append(d.samples, m.samples...)
+		} else {
+			dst[name] = m
+		}
+	}
+}
+
+func addSample(ms map[string]*metric, name, kind, help string, labels map[string]string, v float64) {
+	m, ok := ms[name]
+	if !ok {
+		m = &metric{help: help, kind: kind}
+		ms[name] = m
+	}
+	m.samples = append(m.samples, name+formatLabels(labels)+" "+strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	ls := make([]string, len(keys))
+	for i, k := range keys {
+		ls[i] = fmt.Sprintf(`%s="%s"`, strings.Replace(k, "-", "_", -1), r.Replace(labels[k]))
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
+
+// Formats metrics in the Prometheus text exposition format.
+func formatMetrics(ms map[string]*metric) []byte {
+	names := make([]string, 0, len(ms))
+	for name := range ms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		m := ms[name]
+		sort.Strings(m.samples)
+
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, m.kind)
+		for _, s := range m.samples {
+			fmt.Fprintln(&b, s)
+		}
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,151 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricName(t *testing.T) {
+	tests := []struct {
+		prefix, key string
+		name, kind  string
+	}{
+		{"beanstalkd_", "total-jobs", "beanstalkd_jobs_total", "counter"},
+		{"beanstalkd_", "cmd-put", "beanstalkd_cmd_put_total", "counter"},
+		{"beanstalkd_", "job-timeouts", "beanstalkd_job_timeouts_total", "counter"},
+		{"beanstalkd_", "binlog-records-written", "beanstalkd_binlog_records_written_total", "counter"},
+		{"beanstalkd_", "rusage-utime", "beanstalkd_rusage_utime_seconds_total", "counter"},
+		{"beanstalkd_", "uptime", "beanstalkd_uptime_seconds", "gauge"},
+		{"beanstalkd_", "current-jobs-ready", "beanstalkd_current_jobs_ready", "gauge"},
+		{"beanstalkd_tube_", "pause-time-left", "beanstalkd_tube_pause_time_left_seconds", "gauge"},
+		{"beanstalkd_tube_", "total-jobs", "beanstalkd_tube_jobs_total", "counter"},
+	}
+	for _, test := range tests {
+		name, kind := metricName(test.prefix, test.key)
+		if name != test.name || kind != test.kind {
+			t.Errorf("metricName(%q, %q) = %s, %s, want %s, %s", test.prefix, test.key, name, kind, test.name, test.kind)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		want   string
+	}{
+		{nil, ""},
+		{map[string]string{"tube": "emails", "server": "10.0.0.5:11300"}, `{server="10.0.0.5:11300",tube="emails"}`},
+		{map[string]string{"tube": `a"b\c` + "\nd"}, `{tube="a\"b\\c\nd"}`},
+		{map[string]string{"pause-time-left": "1"}, `{pause_time_left="1"}`},
+	}
+	for _, test := range tests {
+		if got := formatLabels(test.labels); got != test.want {
+			t.Errorf("formatLabels(%v) = %s, want %s", test.labels, got, test.want)
+		}
+	}
+}
+
+// Serves just enough of the protocol for the exporter, passing each
+// accepted connection to conns, so tests can drop it.
+func serveFakeBeanstalkd(l net.Listener, conns chan<- net.Conn) {
+	reply := func(c net.Conn, body string) {
+		fmt.Fprintf(c, "OK %d\r\n%s\r\n", len(body), body)
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conns <- c
+
+		go func(c net.Conn) {
+			r := bufio.NewReader(c)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch strings.Fields(line)[0] {
+				case "stats":
+					reply(c, "---\nversion: 1.10\nid: 1234\nhostname: queue1\nuptime: 5\ncmd-put: 3\ncurrent-jobs-ready: 2\n")
+				case "list-tubes":
+					reply(c, "---\n- default\n")
+				case "stats-tube":
+					reply(c, "---\nname: default\ncurrent-jobs-ready: 2\n")
+				default:
+					fmt.Fprint(c, "UNKNOWN_COMMAND\r\n")
+				}
+			}
+		}(c)
+	}
+}
+
+func TestExporterReconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conns := make(chan net.Conn, 10)
+	go serveFakeBeanstalkd(l, conns)
+
+	accepted := func() net.Conn {
+		select {
+		case c := <-conns:
+			return c
+		case <-time.After(time.Second):
+			t.Fatal("exporter didn't connect")
+			return nil
+		}
+	}
+	e := &exporter{targets: []*target{{addr: l.Addr().String()}}}
+	defer e.targets[0].close()
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+
+	out := scrape()
+	for _, want := range []string{
+		"beanstalkd_up 1\n",
+		`beanstalkd_info{hostname="queue1",id="1234",version="1.10"} 1` + "\n",
+		"beanstalkd_cmd_put_total 3\n",
+		`beanstalkd_tube_current_jobs_ready{tube="default"} 2` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("first scrape is missing %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "beanstalkd_version") || strings.Contains(out, "beanstalkd_id") {
+		t.Errorf("first scrape exports string stats as metrics, got:\n%s", out)
+	}
+
+	// Simulates a restart of the server, the next scrape must reconnect.
+	accepted().Close()
+
+	if out := scrape(); !strings.Contains(out, "beanstalkd_up 1\n") {
+		t.Errorf("scrape after losing the connection failed, got:\n%s", out)
+	}
+	c := accepted()
+
+	// With the server gone, it must be reported as down.
+	l.Close()
+	c.Close()
+
+	if out := scrape(); !strings.Contains(out, "beanstalkd_up 0\n") {
+		t.Errorf("scrape without server doesn't report it as down, got:\n%s", out)
+	}
+}
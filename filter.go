@@ -0,0 +1,142 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Tube statistics available in filters, by the name used in filters.
+var filterKeys = map[string]string{
+	"ready":    "current-jobs-ready",
+	"delayed":  "current-jobs-delayed",
+	"buried":   "current-jobs-buried",
+	"urgent":   "current-jobs-urgent",
+	"reserved": "current-jobs-reserved",
+	"waiting":  "current-waiting",
+	"watching": "current-watching",
+	"using":    "current-using",
+	"pause":    "pause",
+	"paused":   "pause-time-left",
+}
+
+// A single comparison of a tube statistic with a number, i.e. buried>0.
+type condition struct {
+	key   string
+	op    string
+	value int
+}
+
+var conditionRe = regexp.MustCompile(`^([a-z]+)\s*(>=|<=|!=|==|=|>|<)\s*(\d+)$`)
+
+// Parses a filter like "buried>0 and ready>1000" into its conditions.
+// All conditions must be met for a tube to be selected.
+func parseFilter(s string) ([]condition, error) {
+	var cs []condition
+
+	if strings.TrimSpace(s) == "" {
+		return nil, usageError("no conditions given")
+	}
+	for _, part := range regexp.MustCompile(`\s+and\s+`).Split(strings.TrimSpace(s), -1) {
+		m := conditionRe.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil {
+			return nil, usageError(fmt.Sprintf("invalid condition %s", part))
+		}
+		if _, ok := filterKeys[m[1]]; !ok {
+			return nil, usageError(fmt.Sprintf("unknown key %s in condition", m[1]))
+		}
+		v, err := strconv.Atoi(m[3])
+		if err != nil {
+			return nil, usageError(fmt.Sprintf("invalid number in condition %s", part))
+		}
+		cs = append(cs, condition{m[1], m[2], v})
+	}
+	return cs, nil
+}
+
+// Checks if tube statistics meet all conditions.
+func matchFilter(cs []condition, stats map[string]string) bool {
+	for _, c := range cs {
+		v := castStatsValue(stats[filterKeys[c.key]])
+
+		var ok bool
+		switch c.op {
+		case ">":
+			ok = v > c.value
+		case ">=":
+			ok = v >= c.value
+		case "<":
+			ok = v < c.value
+		case "<=":
+			ok = v <= c.value
+		case "=", "==":
+			ok = v == c.value
+		case "!=":
+			ok = v != c.value
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes tubes from the selection, whose statistics don't meet the
+// filter. Statistics of a tube on multiple servers are summed up, pauses
+// are taken from the server where the tube is paused longest.
+func (ts *Tubes) applyFilter() error {
+	if len(ts.Filter) == 0 {
+		return nil
+	}
+	byName := make(map[string][]map[string]string)
+
+	for _, t := range ts.Conns {
+		stats, err := t.Stats()
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		byName[t.Name] = append(byName[t.Name], stats)
+	}
+	var names []string
+
+	for _, tn := range ts.Names {
+		all := byName[tn]
+		stats := sumStats(all)
+		for _, k := range []string{"pause", "pause-time-left"} {
+			for _, s := range all {
+				if castStatsValue(s[k]) > castStatsValue(stats[k]) {
+					stats[k] = s[k]
+				}
+			}
+		}
+		if matchFilter(ts.Filter, stats) {
+			names = append(names, tn)
+		}
+	}
+	var conns = ts.Conns[:0]
+	for _, t := range ts.Conns {
+		if contains(t.Name, names) {
+			conns = append(conns, t)
+		}
+	}
+	ts.Names, ts.Conns = names, conns
+	return nil
+}
+
+// Formats a filter as given to use.
+func formatFilter(cs []condition) string {
+	parts := make([]string, len(cs))
+	for i, c := range cs {
+		parts[i] = fmt.Sprintf("%s%s%d", c.key, c.op, c.value)
+	}
+	return strings.Join(parts, " and ")
+}
@@ -0,0 +1,187 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Number of bytes shown around a match in snippets.
+const snippetContext = 30
+
+// Checks if a job body matches, returns a snippet of the body to show
+// for matches.
+type bodyMatcher func(body []byte) (string, bool)
+
+var (
+	jsonPathRe    = regexp.MustCompile(`^\$?((?:\.?[A-Za-z_][\w-]*|\[\d+\])+)=(.*)$`)
+	jsonSegmentRe = regexp.MustCompile(`\.?([A-Za-z_][\w-]*)|\[(\d+)\]`)
+)
+
+// Searches jobs in given state in selected tubes for bodies matching the
+// pattern, shows at most limit matches if limit is not 0. When
+// interrupted, shows the matches found so far.
+func grepJobs(state string, limit int, pattern string) error {
+	if state != "all" && !contains(state, states) {
+		return usageError("unknown state")
+	}
+	match, err := parseMatcher(pattern)
+	if err != nil {
+		return err
+	}
+	var rs []*record
+
+	err = walkJobs(state, func(j *job) error {
+		if limit != 0 && len(rs) >= limit {
+			return errStop
+		}
+		snippet, ok := match(j.body)
+		if !ok {
+			return nil
+		}
+		r := newRecord().set("id", j.id)
+		if len(servers) > 1 {
+			r.set("server", serverOf(j.conn).addr)
+		}
+		rs = append(rs, r.set("tube", j.tube()).set("state", j.state()).set("snippet", snippet))
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	renderTable(rs)
+	return err
+}
+
+// Parses a grep pattern, which is either a JSON path and the value to
+// compare with (i.e. order.items[0].sku=A-42) or a regular expression.
+// Regular expressions containing = must be enclosed in slashes.
+func parseMatcher(p string) (bodyMatcher, error) {
+	if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		return regexpMatcher(p[1 : len(p)-1])
+	}
+	if m := jsonPathRe.FindStringSubmatch(p); m != nil {
+		return jsonPathMatcher(m[1], m[2]), nil
+	}
+	return regexpMatcher(p)
+}
+
+func regexpMatcher(p string) (bodyMatcher, error) {
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, usageError(fmt.Sprintf("invalid regular expression %s", p))
+	}
+	return func(body []byte) (string, bool) {
+		loc := re.FindIndex(body)
+		if loc == nil {
+			return "", false
+		}
+		return snippet(body, loc[0], loc[1]), true
+	}, nil
+}
+
+// Matches JSON bodies, where the value at given path equals value. Numbers
+// are compared by their value, so 1.0 equals 1.
+func jsonPathMatcher(path, value string) bodyMatcher {
+	segments := jsonSegmentRe.FindAllStringSubmatch(path, -1)
+
+	return func(body []byte) (string, bool) {
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return "", false
+		}
+		for _, s := range segments {
+			var ok bool
+			if s[1] != "" {
+				var o map[string]interface{}
+				if o, ok = v.(map[string]interface{}); ok {
+					v, ok = o[s[1]]
+				}
+			} else {
+				var a []interface{}
+				if a, ok = v.([]interface{}); ok {
+					i, _ := strconv.Atoi(s[2])
+					if ok = i < len(a); ok {
+						v = a[i]
+					}
+				}
+			}
+			if !ok {
+				return "", false
+			}
+		}
+		if !jsonEqual(v, value) {
+			return "", false
+		}
+		return snippet(body, 0, 0), true
+	}
+}
+
+// Compares a decoded JSON value with a value given as text. Strings are
+// compared as is, other values by their JSON representation.
+func jsonEqual(v interface{}, value string) bool {
+	switch v := v.(type) {
+	case string:
+		return v == value
+	case json.Number:
+		if string(v) == value {
+			return true
+		}
+		a, aerr := v.Float64()
+		b, berr := strconv.ParseFloat(value, 64)
+		return aerr == nil && berr == nil && a == b
+	}
+	b, err := json.Marshal(v)
+	return err == nil && string(b) == value
+}
+
+// Cuts a single line snippet out of a body around the part between start
+// and end. Control characters and invalid UTF-8 are replaced, so the
+// snippet can be shown safely.
+func snippet(body []byte, start, end int) string {
+	from, to := start-snippetContext, end+snippetContext
+	if start == end {
+		from, to = 0, 2*snippetContext
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to > len(body) {
+		to = len(body)
+	}
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("...")
+	}
+	for s := body[from:to]; len(s) > 0; {
+		r, n := utf8.DecodeRune(s)
+		switch {
+		case r == utf8.RuneError && n <= 1:
+			b.WriteByte('.')
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		case !unicode.IsPrint(r):
+			b.WriteByte('.')
+		default:
+			b.WriteRune(r)
+		}
+		s = s[n:]
+	}
+	if to < len(body) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
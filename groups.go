@@ -0,0 +1,92 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Saved tube selections by name, as they would be given to use.
+var groups = make(map[string]string)
+
+func groupsFile() string {
+	return filepath.Join(configDir(), "groups")
+}
+
+// Runs a group subcommand: save, use, list or delete.
+func group(args []string) error {
+	if len(args) < 1 {
+		return usageError("no subcommand given, must be one of: save, use, list, delete")
+	}
+	if args[0] == "list" {
+		return listGroups()
+	}
+	if len(args) < 2 {
+		return usageError("no group name given")
+	}
+	name := args[1]
+
+	switch args[0] {
+	case "save":
+		if !isValidName(name) {
+			return usageError("invalid group name")
+		}
+		if len(cTubes.Patterns) == 0 {
+			return usageError("no tubes selected")
+		}
+		sel := formatArgs(cTubes.Patterns)
+		if len(cTubes.Filter) > 0 {
+			sel += " where " + formatFilter(cTubes.Filter)
+		}
+		groups[name] = sel
+		return saveNamed(groupsFile(), groups)
+	case "use":
+		sel, ok := groups[name]
+		if !ok {
+			return fmt.Errorf("unknown group %s", name)
+		}
+		cmds, err := parseLine(sel)
+		if err != nil || len(cmds) != 1 {
+			return fmt.Errorf("invalid selection in group %s", name)
+		}
+		return cTubes.Use(cmds[0])
+	case "delete":
+		if _, ok := groups[name]; !ok {
+			return fmt.Errorf("unknown group %s", name)
+		}
+		delete(groups, name)
+		return saveNamed(groupsFile(), groups)
+	}
+	return usageError("unknown subcommand, must be one of: save, use, list, delete")
+}
+
+func listGroups() error {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rs []*record
+	for _, name := range names {
+		rs = append(rs, newRecord().set("group", name).set("tubes", groups[name]))
+	}
+	return renderTable(rs)
+}
+
+// Returns names of all groups starting with prefix, for completion.
+func groupNames(prefix string) (r []string) {
+	for name := range groups {
+		if strings.HasPrefix(name, prefix) {
+			r = append(r, name)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
@@ -0,0 +1,290 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// A job as found by scanning, without its body.
+type indexedJob struct {
+	server  string
+	id      uint64
+	state   string
+	tube    string
+	pri     uint32
+	created time.Time
+	size    int
+}
+
+func (j *indexedJob) age() int {
+	return int(time.Since(j.created).Seconds())
+}
+
+// Jobs found by the last scan, across all servers.
+type jobIndex struct {
+	jobs   []*indexedJob
+	at     time.Time
+	probed int
+}
+
+// Index built by the last scan, nil if there has been none since
+// connecting.
+var cIndex *jobIndex
+
+// Columns listings of indexed jobs can be sorted by.
+var indexSortKeys = []string{"id", "age", "pri", "size", "tube"}
+
+// Result of probing a single job id, job is nil if there is no such job.
+type probe struct {
+	job *indexedJob
+	err error
+}
+
+// Scans job ids between from and to on all servers and replaces the index
+// with the jobs found. Each server is scanned over given number of
+// connections, probing at most rate ids per second if rate is not 0. If no
+// upper id is given, we start at the highest id and stop once all jobs the
+// server has have been found.
+func scanJobs(from, to uint64, workers, rate int) error {
+	idx := &jobIndex{at: time.Now()}
+
+	for _, s := range servers {
+		if err := scanServer(s, from, to, workers, rate, idx); err != nil {
+			return err
+		}
+	}
+	cIndex = idx
+	return scanSummary(idx)
+}
+
+func scanServer(s *server, from, to uint64, workers, rate int, idx *jobIndex) error {
+	stats, err := s.conn.Stats()
+	if err != nil {
+		return fmt.Errorf("failed to get stats of server %s: %s", s.addr, err)
+	}
+	expect := 0
+	for _, st := range append(states, "reserved") {
+		expect += castStatsValue(stats["current-jobs-"+st])
+	}
+	complete := to == 0
+	if complete {
+		if to, err = highestJobID(s); err != nil {
+			return err
+		}
+	}
+
+	// The server's connection is used by one worker, the others get their
+	// own, as connections can't be shared.
+	conns := []*beanstalk.Conn{s.conn}
+	defer func() {
+		for _, c := range conns[1:] {
+			c.Close()
+		}
+	}()
+	for len(conns) < workers {
+		rwc, err := dialAddr(s.addr, 0)
+		if err != nil {
+			return fmt.Errorf("failed to connect to beanstalkd server %s: %s", s.addr, err)
+		}
+		conns = append(conns, beanstalk.NewConn(rwc))
+	}
+
+	ids := make(chan uint64)
+	probes := make(chan probe)
+	stop := make(chan struct{})
+	var once sync.Once
+	halt := func() { once.Do(func() { close(stop) }) }
+
+	go func() {
+		defer close(ids)
+
+		var tick <-chan time.Time
+		if rate > 0 && time.Duration(rate) <= time.Second {
+			t := time.NewTicker(time.Second / time.Duration(rate))
+			defer t.Stop()
+			tick = t.C
+		}
+		for id := to; id >= from && id > 0; id-- {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case ids <- id:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *beanstalk.Conn) {
+			defer wg.Done()
+
+			for id := range ids {
+				j, err := probeJob(c, s.addr, id, idx.at)
+				select {
+				case probes <- probe{j, err}:
+				case <-stop:
+					return
+				}
+			}
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		close(probes)
+	}()
+
+	p := newProgress(s)
+	defer p.done()
+
+	found := 0
+	for pr := range probes {
+		idx.probed++
+
+		switch {
+		case pr.err != nil:
+			if err == nil {
+				err = pr.err
+			}
+			halt()
+		case interrupted():
+			if err == nil {
+				err = errInterrupted
+			}
+			halt()
+		case pr.job != nil:
+			idx.jobs = append(idx.jobs, pr.job)
+			found++
+		}
+		if complete && found >= expect {
+			halt()
+		}
+		p.update(uint64(idx.probed), found, expect)
+	}
+	return err
+}
+
+// Probes a single job id, fetching the statistics and size of the job.
+// Its creation time is derived from its age at the time the scan started.
+func probeJob(c *beanstalk.Conn, server string, id uint64, at time.Time) (*indexedJob, error) {
+	stats, err := c.StatsJob(id)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats of job %d: %s", id, err)
+	}
+	body, err := c.Peek(id)
+	if isNotFound(err) {
+		// The job has been deleted in the meantime.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to peek at job %d: %s", id, err)
+	}
+	return &indexedJob{
+		server:  server,
+		id:      id,
+		state:   stats["state"],
+		tube:    stats["tube"],
+		pri:     uint32(castStatsValue(stats["pri"])),
+		created: at.Add(-time.Duration(castStatsValue(stats["age"])) * time.Second),
+		size:    len(body),
+	}, nil
+}
+
+// Shows how many jobs in which state the scan found in each selected tube.
+func scanSummary(idx *jobIndex) error {
+	byTube := make(map[string]*record)
+	for _, tn := range cTubes.Names {
+		byTube[tn] = newRecord().set("tube", tn)
+		for _, st := range append(states, "reserved", "size", "oldest") {
+			byTube[tn].set(st, 0)
+		}
+	}
+	for _, j := range idx.jobs {
+		r, ok := byTube[j.tube]
+		if !ok {
+			continue
+		}
+		r.set(j.state, r.get(j.state).(int)+1)
+		r.set("size", r.get("size").(int)+j.size)
+		if j.age() > r.get("oldest").(int) {
+			r.set("oldest", j.age())
+		}
+	}
+	var rs []*record
+	for _, tn := range cTubes.Names {
+		rs = append(rs, byTube[tn])
+	}
+	return renderTable(rs)
+}
+
+// Lists indexed jobs in given state in selected tubes, sorted by given
+// column, at most limit jobs if limit is not 0. Oldest, most urgent and
+// largest jobs come first, jobs with equal values are sorted by id.
+func listJobs(state, sortBy string, limit int) error {
+	if state != "all" && state != "reserved" && !contains(state, states) {
+		return usageError("unknown state")
+	}
+	if !contains(sortBy, indexSortKeys) {
+		return usageError("unknown sort column")
+	}
+	if cIndex == nil {
+		return usageError("no jobs indexed yet, run scan first")
+	}
+	var js []*indexedJob
+	for _, j := range cIndex.jobs {
+		if (state == "all" || j.state == state) && contains(j.tube, cTubes.Names) {
+			js = append(js, j)
+		}
+	}
+	sort.Slice(js, func(a, b int) bool {
+		x, y := js[a], js[b]
+		switch {
+		case sortBy == "age" && !x.created.Equal(y.created):
+			return x.created.Before(y.created)
+		case sortBy == "pri" && x.pri != y.pri:
+			return x.pri < y.pri
+		case sortBy == "size" && x.size != y.size:
+			return x.size > y.size
+		case sortBy == "tube" && x.tube != y.tube:
+			return x.tube < y.tube
+		}
+		return x.id < y.id
+	})
+	if limit != 0 && len(js) > limit {
+		js = js[:limit]
+	}
+
+	var rs []*record
+	for _, j := range js {
+		r := newRecord().set("id", j.id)
+		if len(servers) > 1 {
+			r.set("server", j.server)
+		}
+		rs = append(rs, r.
+			set("tube", j.tube).
+			set("state", j.state).
+			set("pri", j.pri).
+			set("age", j.age()).
+			set("size", j.size))
+	}
+	return renderTable(rs)
+}
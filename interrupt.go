@@ -0,0 +1,82 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// Commands which stop cleanly when interrupted, showing what they have
+// done so far. Ctrl-C quits while running any other command.
+var interruptibleCommands = []string{"copy", "dump", "grep", "scan", "stuck"}
+
+var (
+	interruptMu sync.Mutex
+	interruptc  chan struct{} // Closed once the running command is interrupted.
+
+	errInterrupted = errors.New("interrupted")
+)
+
+// Allows the command about to run to be interrupted by Ctrl-C, instead of
+// quitting. The returned function must be called once it has finished.
+// Commands run by other commands share the interruption of the outermost
+// one.
+func interruptible() func() {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+
+	if interruptc != nil {
+		return func() {}
+	}
+	c := make(chan struct{})
+	interruptc = c
+
+	return func() {
+		interruptMu.Lock()
+		defer interruptMu.Unlock()
+
+		if interruptc == c {
+			interruptc = nil
+		}
+	}
+}
+
+// Interrupts the running command. Returns false if there is none or it
+// has already been interrupted, so we should rather quit.
+func interrupt() bool {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+
+	if interruptc == nil {
+		return false
+	}
+	select {
+	case <-interruptc:
+		return false
+	default:
+		close(interruptc)
+		return true
+	}
+}
+
+// Checks if the running command has been interrupted. Long running
+// commands should check this regularly and stop with errInterrupted.
+func interrupted() bool {
+	interruptMu.Lock()
+	c := interruptc
+	interruptMu.Unlock()
+
+	if c == nil {
+		return false
+	}
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
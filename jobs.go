@@ -6,36 +6,277 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kr/beanstalk"
 )
 
-func inspectJob(id uint64) (err error) {
+// A job as fetched from a server, with its body and statistics.
+type job struct {
+	conn  *beanstalk.Conn // Connection to the server holding the job.
+	id    uint64
+	body  []byte
+	stats map[string]string
+}
+
+// Fetches body and statistics of a job from the server of given
+// connection.
+func fetchJob(c *beanstalk.Conn, id uint64) (*job, error) {
+	body, err := c.Peek(id)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := c.StatsJob(id)
+	if err != nil {
+		return nil, err
+	}
+	return &job{c, id, body, stats}, nil
+}
+
+func (j *job) tube() string {
+	return j.stats["tube"]
+}
+
+func (j *job) state() string {
+	return j.stats["state"]
+}
+
+func (j *job) pri() uint32 {
+	return uint32(castStatsValue(j.stats["pri"]))
+}
+
+func (j *job) ttr() time.Duration {
+	return time.Duration(castStatsValue(j.stats["ttr"])) * time.Second
+}
+
+// Returns the remaining delay of a delayed job, 0 for jobs in any other
+// state.
+func (j *job) delay() time.Duration {
+	if j.state() != "delayed" {
+		return 0
+	}
+	return time.Duration(castStatsValue(j.stats["time-left"])) * time.Second
+}
+
+// Puts a copy of a job into given tube on the same server, using given
+// body and priority. TTR and the remaining delay of the original job are
+// kept.
+func copyJob(j *job, tube string, body []byte, pri uint32) (uint64, error) {
+	t := beanstalk.Tube{Conn: j.conn, Name: tube}
+
+	id, err := t.Put(body, pri, j.delay(), j.ttr())
+	if err == nil {
+		auditJob("put", j.conn, id, tube, body)
+	}
+	return id, err
+}
+
+// Explains why an operation on a job failed. The server responds with
+// NOT_FOUND in many situations, so we look up the job to find out why.
+func jobFailure(c *beanstalk.Conn, id uint64, err error) string {
+	if !isNotFound(err) {
+		return err.Error()
+	}
+	stats, serr := c.StatsJob(id)
+	if serr != nil {
+		return "not found"
+	}
+	if stats["state"] == "reserved" {
+		return "reserved by another client"
+	}
+	return fmt.Sprintf("not possible in state %s", stats["state"])
+}
+
+// Deletes jobs by id and shows the outcome for each job.
+func deleteJobs(ids []uint64) error {
+	if err := confirm(fmt.Sprintf("delete %s %s", formatCount(len(ids)), plural(len(ids), "job"))); err != nil {
+		return err
+	}
+	return eachJob(ids, "deleted", func(id uint64) error {
+		j, err := fetchJob(conn, id)
+		if err != nil {
+			return err
+		}
+		if err := conn.Delete(id); err != nil {
+			return err
+		}
+		auditJob("deleted", conn, id, j.tube(), j.body)
+		return nil
+	})
+}
+
+// Kicks buried or delayed jobs by id and shows the outcome for each job.
+func kickJobs(ids []uint64) error {
+	return eachJob(ids, "kicked", func(id uint64) error {
+		j, err := fetchJob(conn, id)
+		if err != nil {
+			return err
+		}
+		if err := kickJob(conn, id); err != nil {
+			return err
+		}
+		auditJob("kicked", conn, id, j.tube(), j.body)
+		return nil
+	})
+}
+
+// Runs an operation on each job and shows the outcome of each. Returns an
+// error if the operation failed for any job.
+func eachJob(ids []uint64, done string, op func(uint64) error) error {
+	var rs []*record
+	failed := 0
+
+	for _, id := range ids {
+		r := newRecord().set("id", id)
+
+		if err := op(id); err != nil {
+			r.set("result", jobFailure(conn, id, err))
+			failed++
+		} else {
+			r.set("result", done)
+		}
+		rs = append(rs, r)
+	}
+	if err := renderTable(rs); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed for %d of %d jobs", failed, len(ids))
+	}
+	return nil
+}
+
+// Replaces a job with a copy, which is put into given tube using given body
+// and priority. The protocol doesn't allow changing jobs we haven't
+// reserved, so the copy is put first and the original is deleted
+// afterwards. If the original can't be deleted, i.e. because a worker
+// reserved it in the meantime, the copy is deleted again. Should that
+// fail too, the id of the copy left behind is returned with the error.
+func replaceJob(j *job, tube string, body []byte, pri uint32) (uint64, error) {
+	nid, err := copyJob(j, tube, body, pri)
+	if err != nil {
+		return 0, fmt.Errorf("failed to put copy: %s", err)
+	}
+	if err := j.conn.Delete(j.id); err != nil {
+		if cerr := j.conn.Delete(nid); cerr != nil {
+			return nid, fmt.Errorf("%s, failed to delete copy %d: %s", jobFailure(j.conn, j.id, err), nid, cerr)
+		}
+		auditJob("deleted", j.conn, nid, tube, body)
+		return 0, fmt.Errorf("%s", jobFailure(j.conn, j.id, err))
+	}
+	auditJob("deleted", j.conn, j.id, j.tube(), j.body)
+	return nid, nil
+}
+
+// Changes the priority of a ready or delayed job, by replacing it with a
+// copy. The job therefore gets a new id.
+func reprioritizeJob(id uint64, pri uint32) error {
+	j, err := fetchJob(conn, id)
+	if err != nil {
+		return fmt.Errorf("job %d: %s", id, jobFailure(conn, id, err))
+	}
+	if j.state() != "ready" && j.state() != "delayed" {
+		return fmt.Errorf("job %d: not possible in state %s", id, j.state())
+	}
+	nid, err := replaceJob(j, j.tube(), j.body, pri)
+	if err != nil {
+		return fmt.Errorf("job %d: %s", id, err)
+	}
+	return renderTable([]*record{
+		newRecord().set("id", nid).set("previous", id).set("tube", j.tube()).set("pri", pri),
+	})
+}
+
+func inspectJob(id uint64) error {
 	body, err := conn.Peek(id)
+	if isNotFound(err) {
+		return fmt.Errorf("unknown job %v", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to peek job %v: %s", id, err)
+	}
 	stats, _ := conn.StatsJob(id)
 
-	if err != nil {
-		return fmt.Errorf("Unknown job %v", id)
+	return printJob(id, body, stats)
+}
+
+// Puts jobs with given bodies into a tube and shows their ids.
+func putJobs(tube string, bodies [][]byte, pri uint32, delay, ttr time.Duration) error {
+	var rs []*record
+	t := beanstalk.Tube{Conn: conn, Name: tube}
+
+	for _, body := range bodies {
+		id, err := t.Put(body, pri, delay, ttr)
+		if err != nil {
+			renderTable(rs)
+			return fmt.Errorf("failed to put job into tube %s: %s", tube, err)
+		}
+		auditJob("put", conn, id, tube, body)
+		rs = append(rs, newRecord().set("id", id).set("tube", tube))
 	}
-	printJob(id, body, stats)
+	return renderTable(rs)
+}
 
-	return
+// Reads a job body as given on the command line. The body can be given
+// inline, read from a file when prefixed with @ or from stdin when -.
+func readBody(args []string) ([]byte, error) {
+	if len(args) == 1 && args[0] == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	if len(args) == 1 && strings.HasPrefix(args[0], "@") {
+		return ioutil.ReadFile(args[0][1:])
+	}
+	return []byte(strings.Join(args, " ")), nil
 }
 
-func nextJobs(state string) {
-	for _, t := range cTubes.Conns {
-		if id, body, err := peekState(t, state); err == nil {
-			fmt.Printf("Next %s job in %s:\n", state, t.Name)
+// Splits data into lines, each non-empty line becomes a job body.
+func splitBodies(data []byte) (bodies [][]byte) {
+	for _, l := range bytes.Split(data, []byte("\n")) {
+		l = bytes.TrimSuffix(l, []byte("\r"))
+		if len(l) > 0 {
+			bodies = append(bodies, l)
+		}
+	}
+	return bodies
+}
+
+func nextJobs(state string) error {
+	if !contains(state, states) {
+		return usageError("unknown state")
+	}
+	var rs []*record
 
-			stats, _ := conn.StatsJob(id)
-			printJob(id, body, stats)
-			fmt.Println()
+	for _, t := range cTubes.Conns {
+		id, body, err := peekState(t, state)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+		}
+		stats, _ := t.Conn.StatsJob(id)
+		r := jobRecord(id, body, stats)
+		if len(servers) > 1 {
+			r.set("server", serverOf(t.Conn).addr)
 		}
+		rs = append(rs, r)
 	}
+	return renderDetail(rs...)
+}
+
+func printJob(id uint64, body []byte, stats map[string]string) error {
+	return renderDetail(jobRecord(id, body, stats))
 }
 
-func printJob(id uint64, body []byte, stats map[string]string) {
-	fmt.Printf("%25s: %v\n", "id", id)
-	fmt.Printf("%25s:\n---------------------\n%s\n---------------------\n", "body", body)
+// Creates a record for a job, contains id, body and most important
+// statistics.
+func jobRecord(id uint64, body []byte, stats map[string]string) *record {
+	r := newRecord().set("id", id).set("body", body)
 
 	var include = []string{
 		"tube",
@@ -49,5 +290,5 @@ func printJob(id uint64, body []byte, stats map[string]string) {
 		"timeouts",
 		"buries",
 	}
-	printStats(stats, include)
+	return addStats(r, stats, include)
 }
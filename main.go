@@ -6,10 +6,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -21,69 +24,270 @@ import (
 var (
 	// Used for autocompletion.
 	commands = []string{
+		"alias",
 		"clear",
+		"connect",
+		"copy",
+		"delete",
+		"dump",
 		"help",
+		"history",
 		"inspect",
+		"jobs",
 		"exit",
+		"format",
+		"grep",
+		"group",
 		"quit",
+		"reprioritize",
+		"scan",
+		"restore",
 		"kick",
+		"kick-job",
 		"list",
+		"move",
 		"next",
 		"pause",
+		"put",
+		"set",
+		"snapshot",
+		"source",
 		"stats",
+		"stuck",
+		"top",
+		"triage",
+		"unalias",
 		"use",
+		"watch",
 	}
 	hf     = "/tmp/.bsa_history"
-	conn   *beanstalk.Conn // Our one and only beanstalkd connection.
+	addr   string          // Address of the beanstalkd servers, comma separated.
+	conn   *beanstalk.Conn // Connection to the first server, the only one for jobs by id.
 	line   *liner.State
 	cTubes Tubes
 	sigc   chan os.Signal // Signal channel.
+
+	// Commands which don't operate on the selected tubes, or run other
+	// commands doing so.
+	localCommands = []string{"", "exit", "quit", "help", "history", "set", "format", "connect", "use", "source", "watch", "alias", "unalias", "group"}
+
+	// Returned by dispatch when the user asked to leave the console.
+	errQuit = errors.New("quit")
 )
 
+// Errors of this type are caused by invalid input, i.e. a missing argument
+// or an unknown command, rather than by a failing operation.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
 // Prints help and usage.
 func help() {
 	fmt.Printf(`
-clear <state>
+alias [<name> = <command>]
+	Defines an alias for one or multiple commands separated by
+	semicolons, i.e. 'alias drain = pause 3600; list'. Arguments given
+	to an alias are appended to its last command. Without a definition
+	lists all aliases. Aliases are saved in the config directory.
+
+clear [--dry-run] <state>
 	Deletes all jobs in given state and selected tubes.
-	<state> may be either 'ready', 'buried' or 'delayed'.
+	<state> may be either 'ready', 'buried' or 'delayed'. With
+	--dry-run only shows how many jobs would be deleted.
+
+connect <profile|address>
+	Connects to the servers of given profile or address (i.e.
+	10.0.0.5:11300, unix:///run/beanstalkd.sock,
+	ssh://user@host/127.0.0.1:11300 or a comma separated list of
+	these), replacing the current
+	connections. Selects the profile's default tubes, otherwise keeps
+	the current selection.
+
+copy <state> <tube> [<limit>]
+	Copies jobs in given state from selected tubes into given tube, at
+	most <limit> jobs if given. Copies keep priority, TTR and remaining
+	delay of the original jobs.
+
+delete <job> [<job> ...]
+	Deletes jobs by id. Ranges of ids can be given as i.e. 100-250.
+
+grep [-state <state>] [-limit <limit>] <pattern>
+	Searches jobs in selected tubes for bodies matching <pattern>,
+	either a regular expression or a JSON path and value (i.e.
+	order.items[0].sku=A-42). Enclose regular expressions containing
+	'=' in slashes. Only jobs in given state are searched, all by
+	default. Shows at most <limit> matches if given. May take a
+	while on busy servers, press Ctrl-C to stop.
+
+group save|use|delete <name>
+group list
+	Saves the current tube selection under a name, selects the tubes
+	of a saved group, deletes or lists groups. Groups are saved in the
+	config directory.
 
 help
 	Show this wonderful help.
 
+history audit [-n <count>]
+	Shows the most recent entries of the audit log, 20 by default.
+
+dump <state> <file> [-move]
+	Writes all jobs in given state in selected tubes to a new file, one
+	job per line as JSON with body and metadata. With -move jobs are
+	deleted once they have been written.
+
 exit, 
 quit
 	Exit the console.
 
-inspect <job>
-	Inspects a single job.
+format [<format>]
+	Selects the output format, one of 'text', 'json', 'csv' or 'yaml'.
+	If no format is given shows the current one.
+
+inspect <job> [-as <decoder>]
+	Inspects a single job. The format of the body is detected and
+	decoded for display, -as forces a decoder: auto, raw, gzip, zlib,
+	json, php, msgpack, text or hex.
+
+pause [--dry-run] <delay>
+	Pauses selected tubes for given number of seconds. With --dry-run
+	only shows which tubes would be paused.
+
+put [-pri <pri>] [-delay <delay>] [-ttr <ttr>] [-lines] <tube> <body>
+	Puts a job into given tube and shows its id. <body> is either given
+	inline, read from a file when prefixed with '@' (i.e. @job.json) or
+	read from stdin when '-'. With -lines each line of the body becomes
+	a separate job. Delay and TTR are given in seconds or as a duration
+	(i.e. 1m30s), priority defaults to 1024 and TTR to 60 seconds.
 
-pause <delay>
-	Pauses selected tubes for given number of seconds.
+jobs [<state>] [-sort <column>] [-limit <limit>]
+	Lists jobs in given state in selected tubes, as found by the last
+	scan. <state> may be 'ready', 'delayed', 'buried', 'reserved' or
+	'all', the default. Jobs are sorted by id, or by age, pri, size or
+	tube with oldest, most urgent and largest jobs first. Shows at
+	most <limit> jobs if given.
 
-kick <bound>
-	Kicks all jobs in selected tubes.
+kick [--dry-run] <bound>
+	Kicks all jobs in selected tubes. With --dry-run only shows how many
+	jobs would be kicked.
+
+kick-job <job> [<job> ...]
+	Kicks buried or delayed jobs by id. Ranges of ids can be given as
+	i.e. 100-250.
 
 list
 	Lists all selected tubes or if none is selected all exstings tubes 
-	and shows status of each.
+	and shows status of each. When connected to multiple servers, tubes
+	are listed per server followed by their totals.
+
+move <state> <tube> [<limit>]
+	Moves jobs in given state from selected tubes into given tube, at
+	most <limit> jobs if given. Jobs keep priority, TTR and remaining
+	delay, but get new ids. Buried jobs become ready. Ready jobs are
+	reserved while being moved, so workers can't take them meanwhile.
 
 next <state> 
 	Inspects next jobs in given state in selected tubes.
 	<state> may be either 'ready', 'buried' or 'delayed'.
 
+scan [-workers <count>] [-rate <rate>] [<from> [<to>]]
+	Probes job ids to find all jobs on the servers and keeps them in
+	an index for jobs, then shows how many were found in selected
+	tubes. Without <to> starts at the highest id and stops once all
+	jobs have been found. Probes over 4 connections per server by
+	default, at most <rate> ids per second if given.
+
+set [<setting> <value>]
+	Changes a setting for the session or shows all settings. With
+	'set dryrun on' clear, kick and pause behave as if --dry-run was
+	given, other commands changing jobs or tubes are refused. With
+	'set decoder <decoder>' bodies are always decoded with the given
+	decoder, see inspect.
+
+snapshot save|delete <name>
+snapshot diff <name> [<name>|now]
+snapshot list
+	Saves statistics of the servers and all tubes under a name, deletes
+	or lists snapshots. Diff shows how counters changed between two
+	snapshots or since one was taken and their rates per second.
+	Anomalies like growing numbers of buried jobs or tubes whose jobs
+	aren't deleted anymore are highlighted. Snapshots are kept in the
+	state directory.
+
+source <file>
+	Runs commands from given file line by line. Empty lines and
+	lines starting with '#' are ignored.
+
+reprioritize <job> <pri>
+	Changes the priority of a ready or delayed job. The job is copied
+	with the new priority and the original is deleted, the job will
+	therefore get a new id.
+
+restore <file> [-tube <tube>]
+	Puts jobs from a file created by dump, keeping priority, TTR and
+	remaining delay. Jobs are put into their original tube unless
+	<tube> is given. Buried jobs are restored as ready jobs.
+
 stats
-	Shows server statistics. 
+	Shows server statistics. When connected to multiple servers, shows
+	statistics per server followed by their totals.
+
+stuck [-min-age <age>] [-timeouts <count>] [-releases <count>]
+	Finds reserved jobs in selected tubes, which may never be finished
+	by their worker. Also shows jobs that timed out or have been
+	released at least <count> times (3 and 10 by default), as these
+	often point to poison messages. Only jobs at least <age> old are
+	shown, given in seconds or as a duration (i.e. 10m).
+
+top [-interval <interval>] [-sort <column>] [-n <count>]
+	Shows a continuously refreshing table of selected tubes, with
+	changes since the last refresh and rates. Tubes with a growing
+	number of buried jobs are highlighted. Press 's' to change the
+	sort column, any other key to quit. Stops after <count> refreshes
+	if given.
+
+triage [<state>]
+	Walks over jobs in given state in selected tubes and shows each job.
+	Act on a job by pressing: (k)ick, (d)elete, (s)kip, (e)dit body and
+	requeue, (m)ove to another tube, (w)rite body to file or (q)uit.
+	<state> may be either 'ready', 'buried' or 'delayed', defaults
+	to 'buried'.
 
-use [<tube0>] [<tube1> ...]
+unalias <name>
+	Removes an alias.
+
+use [<pattern0>] [<pattern1> ...]
 	Selects one or multiple tubes. Separate multiple tubes by spaces.
-	If no tube name is given resets selection.
+	If no tube name is given resets selection. Besides tube names,
+	globs (mail-*) and regular expressions (/^billing\.(eu|us)$/)
+	select all matching tubes, a leading ! excludes matching tubes.
+	Prefix patterns with + or - to add them to or remove them from
+	the current selection. Patterns are matched again before each
+	command, so new matching tubes are picked up.
+
+use [<pattern0> ...] where <condition> [and <condition> ...]
+	Selects only tubes whose statistics meet all conditions, i.e.
+	'use where buried>0 and ready>1000'. Conditions compare ready,
+	delayed, buried, urgent, reserved, waiting, watching, using, pause
+	or paused with a number, using >, >=, <, <=, = or !=. Conditions
+	are evaluated again before each command.
+
+watch [-n <count>] <interval> <command>
+	Repeatedly runs given command at given interval (i.e. 5s), until
+	any key is pressed or after <count> runs if given.
 
 `)
 }
 
 func cleanup() {
-	conn.Close()
+	disconnect()
+	restoreTerminal()
 
+	if line == nil {
+		return
+	}
 	if f, err := os.Create(hf); err == nil {
 		line.WriteHistory(f)
 		f.Close()
@@ -91,32 +295,136 @@ func cleanup() {
 	line.Close()
 }
 
+// Prints an error returned by a command.
+func printError(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %s.\n", err)
+}
+
+// Maps the error returned by a command to the exit code used in
+// non-interactive mode: 0 on success, 2 on invalid usage and 1 for
+// any other failure.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case usageError:
+		return 2
+	case scriptError:
+		return exitCode(e.err)
+	}
+	if err == errQuit {
+		return 0
+	}
+	return 1
+}
+
 func main() {
 	host := flag.String("host", "127.0.0.1", "beanstalkd host")
 	port := flag.String("port", "11300", "beanstalkd port")
+	addrs := flag.String("addr", "", "comma separated list of beanstalkd addresses, overrides host and port")
+	profileName := flag.String("profile", os.Getenv("BSA_PROFILE"), "connection profile from config file")
+	command := flag.String("c", "", "run given command and exit")
+	script := flag.String("f", "", "run commands from given file and exit")
+	flag.BoolVar(&stopOnError, "stop-on-error", false, "abort scripts on the first failing command")
+	flag.StringVar(&format, "format", format, "output format: text, json, csv or yaml")
+	flag.BoolVar(&readonly, "readonly", false, "refuse commands changing jobs or tubes")
+	flag.BoolVar(&assumeYes, "yes", false, "don't ask for confirmation")
+	flag.StringVar(&auditLog, "audit-log", defaultAuditLog(), "file to record commands changing jobs or tubes in")
 	flag.Parse()
 
-	addr := fmt.Sprintf("%s:%s", *host, *port)
-	c, err := beanstalk.Dial("tcp", addr)
+	if err := selectFormat([]string{format}); err != nil {
+		printError(err)
+		os.Exit(exitCode(err))
+	}
+
+	ps, err := loadConfig(filepath.Join(configDir(), "config"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal: failed to read config: %s\n", err)
+		os.Exit(1)
+	}
+	profiles = ps
+
+	if groups, err = loadNamed(groupsFile()); err == nil {
+		aliases, err = loadNamed(aliasesFile())
+	}
 	if err != nil {
-		fmt.Printf("Fatal: failed to connect to beanstalkd server %s: %s\n", addr, err)
+		fmt.Fprintf(os.Stderr, "Fatal: failed to read config: %s\n", err)
 		os.Exit(1)
 	}
-	conn = c // assign to global
 
-	cTubes.UseAll()
+	// Explicitly given flags take precedence over environment variables,
+	// which take precedence over the default.
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	p := &profile{addr: fmt.Sprintf("%s:%s", *host, *port)}
+	switch {
+	case explicit["addr"]:
+		p.addr = *addrs
+	case explicit["host"] || explicit["port"]:
+	case *profileName != "" && (explicit["profile"] || os.Getenv("BEANSTALK_ADDR") == ""):
+		var ok bool
+		if p, ok = profiles[*profileName]; !ok {
+			fmt.Fprintf(os.Stderr, "Fatal: unknown profile %s\n", *profileName)
+			os.Exit(1)
+		}
+	case os.Getenv("BEANSTALK_ADDR") != "":
+		p.addr = os.Getenv("BEANSTALK_ADDR")
+	}
+	addr = p.addr
+
+	// The exporter uses its own connection, so it can start while the
+	// server is unavailable.
+	if flag.Arg(0) == "exporter" {
+		err := runExporter(flag.Args()[1:])
+		printError(err)
+		os.Exit(exitCode(err))
+	}
+
+	if err := connect(p); err != nil {
+		fmt.Fprintf(os.Stderr, "Fatal: %s\n", err)
+		os.Exit(1)
+	}
 
 	// Register signal handler.
 	sigc = make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt)
 	go func() {
 		for sig := range sigc {
+			if interrupt() {
+				fmt.Fprintln(os.Stderr, "Interrupting, press Ctrl-C again to quit.")
+				continue
+			}
 			fmt.Printf("Caught %v. Bye.\n", sig)
 			cleanup()
 			os.Exit(1)
 		}
 	}()
 
+	// Run non-interactively, when commands are given either via the -c
+	// flag, as positional arguments, in a script file or are piped in.
+	interactive := false
+
+	switch {
+	case *command != "":
+		err = execLine(*command)
+	case flag.NArg() > 0:
+		err = run(flag.Args())
+	case *script != "":
+		err = sourceFile(*script)
+	case !isTerminal():
+		err = runScript("stdin", os.Stdin)
+	default:
+		interactive = true
+	}
+	if !interactive {
+		if err != nil && err != errQuit {
+			printError(err)
+		}
+		cleanup()
+		os.Exit(exitCode(err))
+	}
+
 	//
 	line = liner.NewLiner()
 
@@ -127,14 +435,57 @@ func main() {
 				c = append(c, cmd)
 			}
 		}
+		for name := range aliases {
+			if strings.HasPrefix(name, line) {
+				c = append(c, name)
+			}
+		}
+		if strings.HasPrefix(line, "group use ") || strings.HasPrefix(line, "group delete ") {
+			i := strings.LastIndex(line, " ") + 1
+			for _, name := range groupNames(line[i:]) {
+				c = append(c, line[:i]+name)
+			}
+		}
+		if strings.HasPrefix(line, "snapshot diff ") || strings.HasPrefix(line, "snapshot delete ") {
+			i := strings.LastIndex(line, " ") + 1
+			for _, name := range snapshotNames(line[i:]) {
+				c = append(c, line[:i]+name)
+			}
+		}
 		if strings.HasPrefix(line, "use") {
 			tns, _ := conn.ListTubes()
 			for _, v := range tns {
 				c = append(c, fmt.Sprintf("%s%s", line, v))
 			}
 		}
-		if strings.HasPrefix(line, "clear") || strings.HasPrefix(line, "next") {
-			for _, v := range []string{"ready", "delayed", "buried"} {
+		if strings.HasPrefix(line, "clear") || strings.HasPrefix(line, "next") || strings.HasPrefix(line, "triage") || strings.HasPrefix(line, "dump") ||
+			strings.HasPrefix(line, "move") || strings.HasPrefix(line, "copy") {
+			for _, v := range states {
+				c = append(c, fmt.Sprintf("%s%s", line, v))
+			}
+		}
+		if strings.HasPrefix(line, "jobs") {
+			for _, v := range append(states, "reserved", "all") {
+				c = append(c, fmt.Sprintf("%s%s", line, v))
+			}
+		}
+		if strings.HasPrefix(line, "jobs") && strings.HasSuffix(line, "-sort ") {
+			for _, v := range indexSortKeys {
+				c = append(c, fmt.Sprintf("%s%s", line, v))
+			}
+		}
+		if strings.HasPrefix(line, "grep") && strings.HasSuffix(line, "-state ") {
+			for _, v := range append(states, "all") {
+				c = append(c, fmt.Sprintf("%s%s", line, v))
+			}
+		}
+		if strings.HasPrefix(line, "connect") {
+			for name := range profiles {
+				c = append(c, fmt.Sprintf("%s%s", line, name))
+			}
+		}
+		if strings.HasPrefix(line, "format") {
+			for _, v := range formats {
 				c = append(c, fmt.Sprintf("%s%s", line, v))
 			}
 		}
@@ -149,90 +500,390 @@ func main() {
 
 	fmt.Print("Enter 'help' for available commands and 'exit' to quit.\n\n")
 
-	// Dispatch commands.
 	for {
 		// We may have a new set of selected tubes after an iteration, update prompt.
 		// Show selected tubes in prompt, so that we know what commands operate on.
 
-		var tStatus string
-		if cTubes.All {
-			tStatus = "*"
-		} else {
-			tStatus = strings.Join(cTubes.Names, ", ")
+		tStatus := cTubes.String()
+		// Try once to get back a lost connection, without delaying the
+		// prompt by backing off.
+		cStatus := connName()
+		if disconnected {
+			if redial(promptTimeout) == nil {
+				disconnected = false
+			} else {
+				cStatus += " (disconnected)"
+			}
+		}
+		if isReadonly() {
+			cStatus += " (readonly)"
 		}
-		prompt := fmt.Sprintf("beanstalkd [%s] > ", tStatus)
+		if dryRun {
+			cStatus += " (dry run)"
+		}
+		prompt := fmt.Sprintf("%s [%s] > ", cStatus, tStatus)
 
 		if input, err := line.Prompt(prompt); err == nil {
 			// Always add input to history, even if it contains a syntax error. We
 			// may want to skip back and correct ourselves.
 			line.AppendHistory(input)
 
-			args := strings.Split(input, " ")
-
-			switch args[0] {
-			case "exit", "quit":
-				cleanup()
-				os.Exit(0)
-			case "help":
-				help()
-			case "stats":
-				stats()
-			case "use":
-				if len(args) < 2 || args[1] == "*" {
-					cTubes.UseAll()
-					continue
-				}
-				cTubes.Use(args[1:])
-			case "list":
-				listTubes()
-			case "pause":
-				if len(args) < 2 {
-					fmt.Printf("Error: no delay given.\n")
-					continue
-				}
-				if r, err := strconv.ParseUint(args[1], 0, 0); err == nil {
-					pauseTubes(time.Duration(r) * time.Second)
-					continue
-				}
-				fmt.Printf("Error: given delay is not a valid number.\n")
-			case "kick":
-				if len(args) < 2 {
-					fmt.Printf("Error: no bound given.\n")
-					continue
-				}
-				if r, err := strconv.ParseUint(args[1], 0, 0); err == nil {
-					kickTubes(int(r))
-					continue
+			if err := execLine(input); err != nil {
+				if err == errQuit {
+					cleanup()
+					os.Exit(0)
 				}
-				fmt.Printf("Error: given bound is not a valid number.\n")
-			case "clear":
-				if len(args) < 2 {
-					fmt.Printf("Error: no state given.\n")
-					continue
-				}
-				clearTubes(args[1])
-			case "next":
-				if len(args) < 2 {
-					fmt.Printf("Error: no state given.\n")
-					continue
-				}
-				nextJobs(args[1])
-			case "inspect":
-				if len(args) < 2 {
-					fmt.Printf("Error: no job id given.\n")
-					continue
-				}
-				if r, err := strconv.ParseUint(args[1], 0, 0); err == nil {
-					inspectJob(uint64(r))
-					continue
-				}
-				fmt.Printf("Error: not a valid job id.\n")
-			case "":
-				continue
-			default:
-				fmt.Println("Error: unknown command.")
-				continue
+				printError(err)
 			}
 		}
 	}
 }
+
+// Dispatches a single command, given as a list of arguments with the name
+// of the command being the first. Used by both the interactive and the
+// non-interactive mode.
+func dispatch(args []string) (err error) {
+	if _, ok := aliases[args[0]]; ok {
+		return runAlias(args[0], args[1:])
+	}
+	dry := false
+	if contains(args[0], dryRunCommands) {
+		args, dry = stripDryRun(args)
+		dry = dry || dryRun
+	} else if dryRun && isWriteCommand(args) {
+		return fmt.Errorf("%s doesn't support dry runs, use 'set dryrun off' first", args[0])
+	}
+	if err := checkSingleServer(args); err != nil {
+		return err
+	}
+	// Tubes matching the selection may have been created or deleted
+	// since the last command.
+	if !contains(args[0], localCommands) && cTubes.Dynamic() {
+		if err := cTubes.Refresh(); err != nil {
+			return err
+		}
+	}
+	if !dry && isWriteCommand(args) {
+		if err := checkWritable(args); err != nil {
+			return err
+		}
+		if err := beginAudit(args); err != nil {
+			return err
+		}
+		defer func() { endAudit(err) }()
+	}
+	switch args[0] {
+	case "exit", "quit":
+		return errQuit
+	case "help":
+		help()
+	case "stats":
+		return stats()
+	case "connect":
+		if len(args) < 2 {
+			return usageError("no profile or address given")
+		}
+		return connectTo(args[1])
+	case "format":
+		return selectFormat(args[1:])
+	case "set":
+		return set(args[1:])
+	case "alias":
+		return defineAlias(strings.Join(args, " "))
+	case "unalias":
+		if len(args) < 2 {
+			return usageError("no alias given")
+		}
+		return removeAlias(args[1])
+	case "snapshot":
+		return snapshotCmd(args[1:])
+	case "group":
+		return group(args[1:])
+	case "history":
+		if len(args) < 2 || args[1] != "audit" {
+			return usageError("unknown history, must be: audit")
+		}
+		return auditHistory(args[2:])
+	case "source":
+		if len(args) < 2 {
+			return usageError("no file given")
+		}
+		return sourceFile(args[1])
+	case "use":
+		if len(args) < 2 {
+			return cTubes.UseAll()
+		}
+		return cTubes.Use(args[1:])
+	case "list":
+		return listTubes()
+	case "pause":
+		if len(args) < 2 {
+			return usageError("no delay given")
+		}
+		r, err := strconv.ParseUint(args[1], 0, 0)
+		if err != nil {
+			return usageError("given delay is not a valid number")
+		}
+		if dry {
+			return dryPauseTubes(time.Duration(r) * time.Second)
+		}
+		return pauseTubes(time.Duration(r) * time.Second)
+	case "kick":
+		if len(args) < 2 {
+			return usageError("no bound given")
+		}
+		r, err := strconv.ParseUint(args[1], 0, 0)
+		if err != nil {
+			return usageError("given bound is not a valid number")
+		}
+		if dry {
+			return dryKickTubes(int(r))
+		}
+		return kickTubes(int(r))
+	case "clear":
+		if len(args) < 2 {
+			return usageError("no state given")
+		}
+		if dry {
+			return dryClearTubes(args[1])
+		}
+		return clearTubes(args[1])
+	case "next":
+		if len(args) < 2 {
+			return usageError("no state given")
+		}
+		return nextJobs(args[1])
+	case "inspect":
+		fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+		as := fs.String("as", bodyDecoder, "decoder for the body")
+
+		rest, err := parseInterspersedFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) < 1 {
+			return usageError("no job id given")
+		}
+		r, err := strconv.ParseUint(rest[0], 0, 0)
+		if err != nil {
+			return usageError("not a valid job id")
+		}
+		if err := checkDecoder(*as); err != nil {
+			return err
+		}
+		defer func(prev string) { bodyDecoder = prev }(bodyDecoder)
+		bodyDecoder = *as
+
+		return inspectJob(r)
+	case "delete", "kick-job":
+		if len(args) < 2 {
+			return usageError("no job id given")
+		}
+		ids, err := parseIDs(args[1:])
+		if err != nil {
+			return err
+		}
+		if args[0] == "delete" {
+			return deleteJobs(ids)
+		}
+		return kickJobs(ids)
+	case "reprioritize":
+		if len(args) < 3 {
+			return usageError("no job id or priority given")
+		}
+		id, err := strconv.ParseUint(args[1], 0, 0)
+		if err != nil {
+			return usageError("not a valid job id")
+		}
+		pri, err := strconv.ParseUint(args[2], 0, 32)
+		if err != nil {
+			return usageError("given priority is not a valid number")
+		}
+		return reprioritizeJob(id, uint32(pri))
+	case "top":
+		fs := flag.NewFlagSet("top", flag.ContinueOnError)
+		sortBy := fs.String("sort", "tube", "sort column")
+		count := fs.Int("n", 0, "number of refreshes")
+		interval := durationValue(2 * time.Second)
+		fs.Var(&interval, "interval", "refresh interval")
+
+		if err := parseFlags(fs, args[1:]); err != nil {
+			return err
+		}
+		if interval <= 0 {
+			return usageError("interval must be positive")
+		}
+		return top(time.Duration(interval), *sortBy, *count)
+	case "watch":
+		fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+		count := fs.Int("n", 0, "number of refreshes")
+
+		if err := parseFlags(fs, args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() < 2 {
+			return usageError("no interval or command given")
+		}
+		interval, err := parseDuration(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if interval <= 0 {
+			return usageError("interval must be positive")
+		}
+		return watch(interval, strings.Join(fs.Args()[1:], " "), *count)
+	case "dump":
+		state, file, move, err := parseDumpArgs(args[1:])
+		if err != nil {
+			return err
+		}
+		return dumpJobs(state, file, move)
+	case "grep":
+		fs := flag.NewFlagSet("grep", flag.ContinueOnError)
+		state := fs.String("state", "all", "state of jobs to search")
+		limit := fs.Int("limit", 0, "maximum number of matches")
+
+		rest, err := parseInterspersedFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) < 1 {
+			return usageError("no pattern given")
+		}
+		if *limit < 0 {
+			return usageError("limit must not be negative")
+		}
+		return grepJobs(*state, *limit, strings.Join(rest, " "))
+	case "stuck":
+		fs := flag.NewFlagSet("stuck", flag.ContinueOnError)
+		minAge := durationValue(0)
+		fs.Var(&minAge, "min-age", "minimum age of jobs")
+		timeouts := fs.Int("timeouts", 3, "timeouts to flag a job")
+		releases := fs.Int("releases", 10, "releases to flag a job")
+
+		if err := parseFlags(fs, args[1:]); err != nil {
+			return err
+		}
+		if *timeouts < 1 || *releases < 1 {
+			return usageError("counts must be at least 1")
+		}
+		return stuckJobs(time.Duration(minAge), *timeouts, *releases)
+	case "scan":
+		fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+		workers := fs.Int("workers", 4, "connections per server")
+		rate := fs.Int("rate", 0, "maximum ids probed per second")
+
+		rest, err := parseInterspersedFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if *workers < 1 {
+			return usageError("workers must be at least 1")
+		}
+		if *rate < 0 {
+			return usageError("rate must not be negative")
+		}
+		var ids [2]uint64
+		for i := range rest {
+			if i >= len(ids) {
+				return usageError("too many arguments")
+			}
+			if ids[i], err = strconv.ParseUint(rest[i], 0, 0); err != nil || ids[i] == 0 {
+				return usageError("not a valid job id")
+			}
+		}
+		if ids[0] == 0 {
+			ids[0] = 1
+		}
+		if ids[1] != 0 && ids[1] < ids[0] {
+			return usageError("first id must not be greater than last")
+		}
+		return scanJobs(ids[0], ids[1], *workers, *rate)
+	case "jobs":
+		fs := flag.NewFlagSet("jobs", flag.ContinueOnError)
+		sortBy := fs.String("sort", "id", "sort column")
+		limit := fs.Int("limit", 0, "maximum number of jobs")
+
+		rest, err := parseInterspersedFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		state := "all"
+		if len(rest) > 0 {
+			state = rest[0]
+		}
+		if *limit < 0 {
+			return usageError("limit must not be negative")
+		}
+		return listJobs(state, *sortBy, *limit)
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+		tube := fs.String("tube", "", "put all jobs into given tube")
+
+		rest, err := parseInterspersedFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) < 1 {
+			return usageError("no file given")
+		}
+		return restoreJobs(rest[0], *tube)
+	case "move", "copy":
+		if len(args) < 3 {
+			return usageError("no state or destination tube given")
+		}
+		limit := 0
+		if len(args) > 3 {
+			r, err := strconv.ParseUint(args[3], 0, 0)
+			if err != nil {
+				return usageError("given limit is not a valid number")
+			}
+			limit = int(r)
+		}
+		if args[0] == "move" {
+			return moveJobs(args[1], args[2], limit)
+		}
+		return copyJobs(args[1], args[2], limit)
+	case "triage":
+		state := "buried"
+		if len(args) > 1 {
+			state = args[1]
+		}
+		return triage(state)
+	case "put":
+		fs := flag.NewFlagSet("put", flag.ContinueOnError)
+		pri := fs.Uint("pri", 1024, "priority")
+		lines := fs.Bool("lines", false, "put one job per line")
+		delay := durationValue(0)
+		ttr := durationValue(60 * time.Second)
+		fs.Var(&delay, "delay", "delay")
+		fs.Var(&ttr, "ttr", "time to run")
+
+		if err := parseFlags(fs, args[1:]); err != nil {
+			return err
+		}
+		if *pri > math.MaxUint32 {
+			return usageError("given priority is out of range")
+		}
+		if fs.NArg() < 1 {
+			return usageError("no tube given")
+		}
+		if fs.NArg() < 2 {
+			return usageError("no body given")
+		}
+		body, err := readBody(fs.Args()[1:])
+		if err != nil {
+			return fmt.Errorf("failed to read body: %s", err)
+		}
+		bodies := [][]byte{body}
+		if *lines {
+			bodies = splitBodies(body)
+		}
+		return putJobs(fs.Arg(0), bodies, uint32(*pri), time.Duration(delay), time.Duration(ttr))
+	case "":
+		return nil
+	default:
+		return usageError("unknown command")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+
+	"github.com/kr/beanstalk"
+)
+
+// Sends a command the beanstalk package doesn't provide to the server and
+// returns the response line. Uses a separate connection, which is opened
+// on first use. Error responses are mapped to the errors of the beanstalk
+// package.
+func (s *server) rawCmd(format string, args ...interface{}) (string, error) {
+	if s.rconn == nil {
+		c, err := dialAddr(s.addr, 0)
+		if err != nil {
+			return "", err
+		}
+		s.rconn = textproto.NewConn(c)
+	}
+	id, err := s.rconn.Cmd(format, args...)
+	if err != nil {
+		s.rconn.Close()
+		s.rconn = nil
+		return "", err
+	}
+	s.rconn.StartResponse(id)
+	defer s.rconn.EndResponse(id)
+
+	line, err := s.rconn.ReadLine()
+	if err != nil {
+		s.rconn.Close()
+		s.rconn = nil
+		return "", err
+	}
+	if err := respError(line); err != nil {
+		return line, err
+	}
+	return line, nil
+}
+
+// Maps error responses to errors of the beanstalk package.
+func respError(line string) error {
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return fmt.Errorf("empty response")
+	}
+	switch f[0] {
+	case "NOT_FOUND":
+		return beanstalk.ErrNotFound
+	case "BAD_FORMAT":
+		return beanstalk.ErrBadFormat
+	case "UNKNOWN_COMMAND":
+		return beanstalk.ErrUnknown
+	case "INTERNAL_ERROR":
+		return beanstalk.ErrInternal
+	case "OUT_OF_MEMORY":
+		return beanstalk.ErrOOM
+	}
+	return nil
+}
+
+// Moves a single buried or delayed job into the ready queue, on the server
+// of given connection.
+func kickJob(c *beanstalk.Conn, id uint64) error {
+	line, err := serverOf(c).rawCmd("kick-job %d", id)
+	if err != nil {
+		return err
+	}
+	if line != "KICKED" {
+		return fmt.Errorf("unexpected response: %s", line)
+	}
+	return nil
+}
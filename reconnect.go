@@ -0,0 +1,154 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// Time to wait for a server when reconnecting or checking its connection.
+// The prompt waits only shortly, so it doesn't hang while a server is
+// unreachable.
+const (
+	reconnectTimeout = 5 * time.Second
+	promptTimeout    = 1 * time.Second
+	checkTimeout     = 2 * time.Second
+)
+
+// Delays between attempts to reconnect, after a connection has been lost.
+var reconnectBackoff = []time.Duration{
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	4 * time.Second,
+	8 * time.Second,
+}
+
+// Set when the connection has been lost and reconnecting failed, until we
+// have been able to reconnect.
+var disconnected bool
+
+// Checks if the error is caused by a lost connection, opposed to an error
+// response from the server.
+func isConnLost(err error) bool {
+	var cerr beanstalk.ConnError
+	if !errors.As(err, &cerr) {
+		return false
+	}
+	var nerr net.Error
+
+	return errors.Is(cerr.Err, io.EOF) ||
+		errors.Is(cerr.Err, io.ErrUnexpectedEOF) ||
+		errors.Is(cerr.Err, syscall.EPIPE) ||
+		errors.Is(cerr.Err, syscall.ECONNRESET) ||
+		errors.As(cerr.Err, &nerr)
+}
+
+// Checks each server with a cheap command and returns the first error
+// indicating a lost connection. A server not answering in time counts as
+// lost: once a command failed half way, the client library waits for it
+// forever and the connection never answers again.
+func checkServers() error {
+	for _, s := range servers {
+		errc := make(chan error, 1)
+		go func(c *beanstalk.Conn) {
+			_, err := c.ListTubes()
+			errc <- err
+		}(s.conn)
+
+		select {
+		case err := <-errc:
+			if isConnLost(err) {
+				return fmt.Errorf("lost connection to %s: %s", s.addr, err)
+			}
+		case <-time.After(checkTimeout):
+			return fmt.Errorf("lost connection to %s: not responding", s.addr)
+		}
+	}
+	return nil
+}
+
+// Runs a command, which may be interrupted by Ctrl-C if it supports that.
+// When it fails because the connection to a server has been lost,
+// reconnects and runs it once more, if that is safe to do.
+func run(args []string) error {
+	if contains(args[0], interruptibleCommands) {
+		defer interruptible()()
+	}
+
+	if disconnected {
+		if err := reconnect(); err != nil {
+			return err
+		}
+	}
+	err := dispatch(args)
+	if err == nil || err == errQuit {
+		return err
+	}
+	cerr := checkServers()
+	if cerr == nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Error: %s, reconnecting.\n", cerr)
+
+	if err := reconnect(); err != nil {
+		return err
+	}
+	if !isRetryable(args) {
+		return fmt.Errorf("%s, reconnected but not running %s again as it may have changed jobs already", err, args[0])
+	}
+	return dispatch(args)
+}
+
+// Checks if a command can be run again after reconnecting. Commands
+// changing jobs may have partly succeeded, so running them again could
+// i.e. duplicate jobs. Commands running other commands retry those
+// themselves.
+func isRetryable(args []string) bool {
+	if _, ok := aliases[args[0]]; ok {
+		return false
+	}
+	return args[0] != "source" && args[0] != "watch" && !isWriteCommand(args)
+}
+
+// Reconnects to all servers of the current connection, retrying with
+// increasing delays. Restores the tube selection once connected.
+func reconnect() error {
+	for i := 0; ; i++ {
+		err := redial(reconnectTimeout)
+		if err == nil {
+			disconnected = false
+			return nil
+		}
+		if i == len(reconnectBackoff) {
+			disconnected = true
+			return fmt.Errorf("failed to reconnect: %s", err)
+		}
+		time.Sleep(reconnectBackoff[i])
+	}
+}
+
+// Replaces connections to all servers without changing the selected tubes.
+// Gives up on a server after timeout.
+func redial(timeout time.Duration) error {
+	ss, err := dial(cProfile.addr, timeout)
+	if err != nil {
+		return err
+	}
+	disconnect()
+	servers = ss
+	conn = ss[0].conn
+	return cTubes.Refresh()
+}
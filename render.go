@@ -0,0 +1,320 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+var (
+	// Available output formats, the first one is the default.
+	formats   = []string{"text", "json", "csv", "yaml"}
+	renderers = map[string]renderer{
+		"text": textRenderer{},
+		"json": jsonRenderer{},
+		"csv":  csvRenderer{},
+		"yaml": yamlRenderer{},
+	}
+	format = "text" // Currently selected output format.
+)
+
+// A record describes a single entity, i.e. a tube, a job or the server,
+// as a set of fields. Fields keep the order in which they were added.
+type record struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newRecord() *record {
+	return &record{values: make(map[string]interface{})}
+}
+
+// Sets a field, returns the record so calls can be chained.
+func (r *record) set(k string, v interface{}) *record {
+	if _, ok := r.values[k]; !ok {
+		r.keys = append(r.keys, k)
+	}
+	r.values[k] = v
+	return r
+}
+
+func (r *record) get(k string) interface{} {
+	return r.values[k]
+}
+
+// A renderer writes records in a specific output format.
+type renderer interface {
+	// Renders records of the same kind as rows, i.e. a list of tubes.
+	table(w io.Writer, rs []*record) error
+
+	// Renders each record in full, i.e. server or job stats.
+	detail(w io.Writer, rs []*record) error
+}
+
+// Renders records as rows using the selected output format.
+func renderTable(rs []*record) error {
+	return renderers[format].table(os.Stdout, rs)
+}
+
+// Renders each record in full using the selected output format.
+func renderDetail(rs ...*record) error {
+	return renderers[format].detail(os.Stdout, rs)
+}
+
+// Renders records as a table, highlighting those for which hl returns true
+// when writing text to a terminal.
+func renderHighlighted(rs []*record, hl func(*record) bool) error {
+	if !useColor() {
+		return renderTable(rs)
+	}
+	return highlightTable(os.Stdout, rs, hl)
+}
+
+// Renders records as a text table, records for which hl returns true are
+// shown in bold red.
+func highlightTable(w io.Writer, rs []*record, hl func(*record) bool) error {
+	var table bytes.Buffer
+	if err := (textRenderer{}).table(&table, rs); err != nil {
+		return err
+	}
+	for i, l := range strings.SplitAfter(table.String(), "\n") {
+		// The first two lines are the header.
+		if i >= 2 && i-2 < len(rs) && hl(rs[i-2]) {
+			l = "\033[1;31m" + strings.TrimSuffix(l, "\n") + "\033[0m\n"
+		}
+		if _, err := io.WriteString(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Selects the output format, shows the current one if none is given.
+func selectFormat(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("Output format is %s.\n", format)
+		return nil
+	}
+	if _, ok := renderers[args[0]]; !ok {
+		return usageError(fmt.Sprintf("unknown format, must be one of: %s", strings.Join(formats, ", ")))
+	}
+	format = args[0]
+	return nil
+}
+
+// Returns all keys used by the given records, in order of first
+// appearance.
+func recordKeys(rs []*record) (keys []string) {
+	for _, r := range rs {
+		for _, k := range r.keys {
+			if !contains(k, keys) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// Converts a value, so it can be used in structured formats. Byte slices
+// are converted to strings, binary ones are base64 encoded.
+func plainValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		if utf8.Valid(b) {
+			return string(b)
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return v
+}
+
+// Formats a value for display in text or CSV output.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", plainValue(v))
+}
+
+// Renders records as human readable text. Tables are right aligned,
+// details are printed as key/value pairs, multi line values are fenced.
+type textRenderer struct{}
+
+func (textRenderer) table(w io.Writer, rs []*record) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	keys := recordKeys(rs)
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(tw, "%s\t\n", strings.Join(keys, "\t"))
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s\t", strings.Repeat("-", len(k)))
+	}
+	fmt.Fprintln(tw)
+
+	for _, r := range rs {
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t", formatValue(r.get(k)))
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+func (textRenderer) detail(w io.Writer, rs []*record) error {
+	for i, r := range rs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		for _, k := range r.keys {
+			if b, ok := r.get(k).([]byte); ok {
+				out, used, err := decodeBody(b, bodyDecoder)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%25s: (%s)\n---------------------\n%s\n---------------------\n", k, strings.Join(used, ", "), out)
+				continue
+			}
+			fmt.Fprintf(w, "%25s: %v\n", k, r.get(k))
+		}
+	}
+	return nil
+}
+
+// Renders records as JSON Lines, one object per record. Makes it easy
+// to process output with tools like jq.
+type jsonRenderer struct{}
+
+func (jsonRenderer) table(w io.Writer, rs []*record) error {
+	return jsonRenderer{}.detail(w, rs)
+}
+
+func (jsonRenderer) detail(w io.Writer, rs []*record) error {
+	e := json.NewEncoder(w)
+	for _, r := range rs {
+		if err := e.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Implements json.Marshaler, so that fields keep their order.
+func (r *record) MarshalJSON() ([]byte, error) {
+	var b strings.Builder
+
+	b.WriteString("{")
+	for i, k := range r.keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		kj, _ := json.Marshal(k)
+		vj, err := json.Marshal(plainValue(r.get(k)))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(kj)
+		b.WriteString(":")
+		b.Write(vj)
+	}
+	b.WriteString("}")
+	return []byte(b.String()), nil
+}
+
+// Renders records as CSV with a header row, columns are the union of
+// all fields.
+type csvRenderer struct{}
+
+func (csvRenderer) table(w io.Writer, rs []*record) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	keys := recordKeys(rs)
+	cw := csv.NewWriter(w)
+
+	cw.Write(keys)
+	for _, r := range rs {
+		row := make([]string, len(keys))
+		for i, k := range keys {
+			row[i] = formatValue(r.get(k))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (csvRenderer) detail(w io.Writer, rs []*record) error {
+	return csvRenderer{}.table(w, rs)
+}
+
+// Renders records as YAML, tables become a sequence of mappings,
+// details a stream of documents.
+type yamlRenderer struct{}
+
+// Matches strings that can safely be used as plain, unquoted scalars.
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_./][A-Za-z0-9_./ -]*[A-Za-z0-9_./]$|^[A-Za-z_./]$`)
+
+func (yamlRenderer) table(w io.Writer, rs []*record) error {
+	for _, r := range rs {
+		for i, k := range r.keys {
+			if i == 0 {
+				fmt.Fprint(w, "- ")
+			} else {
+				fmt.Fprint(w, "  ")
+			}
+			fmt.Fprintf(w, "%s: %s\n", yamlScalar(k), yamlScalar(r.get(k)))
+		}
+	}
+	return nil
+}
+
+func (yamlRenderer) detail(w io.Writer, rs []*record) error {
+	for _, r := range rs {
+		fmt.Fprintln(w, "---")
+		for _, k := range r.keys {
+			fmt.Fprintf(w, "%s: %s\n", yamlScalar(k), yamlScalar(r.get(k)))
+		}
+	}
+	return nil
+}
+
+// Formats a value as a YAML scalar. Strings are double quoted unless
+// they are unambiguous.
+func yamlScalar(v interface{}) string {
+	switch v := plainValue(v).(type) {
+	case nil:
+		return "null"
+	case bool, int, int64, uint64, uint32, float64:
+		return fmt.Sprintf("%v", v)
+	case string:
+		switch strings.ToLower(v) {
+		case "true", "false", "yes", "no", "on", "off", "null", "~":
+			return strconv.Quote(v)
+		}
+		if yamlPlain.MatchString(v) {
+			return v
+		}
+		return strconv.Quote(v)
+	default:
+		return strconv.Quote(fmt.Sprintf("%v", v))
+	}
+}
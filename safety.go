@@ -0,0 +1,178 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Commands which change jobs or tubes, refused in read-only mode.
+var writeCommands = []string{
+	"clear",
+	"copy",
+	"delete",
+	"kick",
+	"kick-job",
+	"move",
+	"pause",
+	"put",
+	"reprioritize",
+	"restore",
+	"triage",
+}
+
+var (
+	readonly  bool // Set by the -readonly flag or a profile asking for it.
+	assumeYes bool // Set by the -yes flag, skips confirmations.
+
+	errAborted = errors.New("aborted")
+)
+
+// Checks if we are in read-only mode, either by flag or because a profile
+// asked for it.
+func isReadonly() bool {
+	return readonly
+}
+
+// Checks if given command changes jobs or tubes. Dump does so only when
+// moving jobs, which we learn by parsing its arguments the same way the
+// command itself does.
+func isWriteCommand(args []string) bool {
+	if args[0] == "dump" {
+		_, _, move, err := parseDumpArgs(args[1:])
+		return err == nil && move
+	}
+	return contains(args[0], writeCommands)
+}
+
+// Returns an error if given command must not be run in read-only mode.
+func checkWritable(args []string) error {
+	if isReadonly() && isWriteCommand(args) {
+		return fmt.Errorf("%s is not allowed in read-only mode", args[0])
+	}
+	return nil
+}
+
+// Asks the user to confirm an action, by answering a question with y or
+// yes. Confirmation is not possible when input isn't coming from a
+// terminal, unless confirmations are skipped via -yes.
+func confirm(question string) error {
+	if assumeYes {
+		return nil
+	}
+	if line == nil && !isTerminal() {
+		return fmt.Errorf("refusing to %s without confirmation, use -yes", question)
+	}
+	answer, err := readLine(question + "? [y/N] ")
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errAborted
+}
+
+// Asks to confirm an action on all jobs in given state in selected tubes,
+// i.e. "delete 4,213 buried jobs in 7 tubes". Counts are taken from tube
+// statistics and limited to limit, if not 0. Jobs in tube except aren't
+// counted, as the action leaves them alone. Nothing is asked if there are
+// no such jobs.
+func confirmState(action, state string, limit int, except string) error {
+	jobs, tubes, err := countState(state, except)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && jobs > limit {
+		jobs = limit
+	}
+	if jobs == 0 {
+		return nil
+	}
+	return confirm(fmt.Sprintf("%s %s %s %s in %s %s",
+		action, formatCount(jobs), state, plural(jobs, "job"), formatCount(tubes), plural(tubes, "tube")))
+}
+
+// Asks to confirm kicking jobs in selected tubes. Like the server, counts
+// buried jobs of a tube or its delayed jobs, if there are no buried ones.
+func confirmKick(bound int) error {
+	jobs, tubes := 0, 0
+	seen := make(map[string]bool)
+
+	for _, t := range cTubes.Conns {
+		stats, err := t.Stats()
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		n := castStatsValue(stats["current-jobs-buried"])
+		if n == 0 {
+			n = castStatsValue(stats["current-jobs-delayed"])
+		}
+		if n > bound {
+			n = bound
+		}
+		if n > 0 && !seen[t.Name] {
+			seen[t.Name] = true
+			tubes++
+		}
+		jobs += n
+	}
+	if jobs == 0 {
+		return nil
+	}
+	return confirm(fmt.Sprintf("kick %s %s in %s %s",
+		formatCount(jobs), plural(jobs, "job"), formatCount(tubes), plural(tubes, "tube")))
+}
+
+// Counts jobs in given state in selected tubes across all servers, except
+// in given tube, and the number of tubes having such jobs.
+func countState(state, except string) (jobs int, tubes int, err error) {
+	seen := make(map[string]bool)
+
+	for _, t := range cTubes.Conns {
+		if t.Name == except {
+			continue
+		}
+		stats, err := t.Stats()
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		n := castStatsValue(stats["current-jobs-"+state])
+		if n > 0 && !seen[t.Name] {
+			seen[t.Name] = true
+			tubes++
+		}
+		jobs += n
+	}
+	return jobs, tubes, nil
+}
+
+// Formats a number with thousands separators.
+func formatCount(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0 && s[i-1] != '-'; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// Helper function to pluralize a word, depending on n.
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
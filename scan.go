@@ -0,0 +1,183 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Number of consecutive unknown ids after which we assume there are no
+// jobs with higher ids.
+const scanGap = 100
+
+// Returns the highest job id the server is likely to have handed out. Ids
+// are assigned sequentially, but may continue from a binlog after a
+// restart, so we also take the ids of queue heads into account and probe
+// beyond that.
+func highestJobID(s *server) (uint64, error) {
+	stats, err := s.conn.Stats()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get stats of server %s: %s", s.addr, err)
+	}
+	hi := uint64(castStatsValue(stats["total-jobs"]))
+
+	for _, t := range cTubes.Conns {
+		if t.Conn != s.conn {
+			continue
+		}
+		for _, state := range states {
+			if id, _, err := peekState(t, state); err == nil && id > hi {
+				hi = id
+			}
+		}
+	}
+	for id, misses := hi+1, 0; misses < scanGap; id++ {
+		_, err := s.conn.StatsJob(id)
+		if err != nil && !isNotFound(err) {
+			return 0, fmt.Errorf("failed to get stats of job %d: %s", id, err)
+		}
+		if err == nil {
+			hi, misses = id, 0
+		} else {
+			misses++
+		}
+	}
+	return hi, nil
+}
+
+// Counts jobs in given state in selected tubes on the server. State all
+// counts jobs in any state, including reserved ones.
+func countJobs(s *server, state string) (int, error) {
+	n := 0
+
+	for _, t := range cTubes.Conns {
+		if t.Conn != s.conn {
+			continue
+		}
+		stats, err := t.Stats()
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		if state != "all" {
+			n += castStatsValue(stats["current-jobs-"+state])
+			continue
+		}
+		for _, st := range append(states, "reserved") {
+			n += castStatsValue(stats["current-jobs-"+st])
+		}
+	}
+	return n, nil
+}
+
+// Calls fn for every job in given state in selected tubes, without
+// changing any job. The protocol only allows peeking at the head of each
+// queue, so job ids are probed from the highest one downwards, until all
+// jobs we expect from tube statistics have been found. Jobs are passed to
+// fn in order of their ids, server by server. State all walks jobs in any
+// state. Walking stops with errInterrupted, once interrupted.
+func walkJobs(state string, fn func(j *job) error) error {
+	if state != "all" && !contains(state, states) {
+		return usageError("unknown state")
+	}
+	for _, s := range servers {
+		if err := walkServerJobs(s, state, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkServerJobs(s *server, state string, fn func(j *job) error) error {
+	expect, err := countJobs(s, state)
+	if err != nil {
+		return err
+	}
+	hi, err := highestJobID(s)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+
+	p := newProgress(s)
+	defer p.done()
+
+	for id := hi; id > 0 && len(ids) < expect; id-- {
+		if interrupted() {
+			return errInterrupted
+		}
+		p.update(hi-id+1, len(ids), expect)
+
+		stats, err := s.conn.StatsJob(id)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get stats of job %d: %s", id, err)
+		}
+		if (state == "all" || stats["state"] == state) && contains(stats["tube"], cTubes.Names) {
+			ids = append(ids, id)
+		}
+	}
+	p.done()
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		if interrupted() {
+			return errInterrupted
+		}
+		j, err := fetchJob(s.conn, ids[i])
+		if isNotFound(err) {
+			// The job has been deleted in the meantime.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch job %d: %s", ids[i], err)
+		}
+		if state != "all" && j.state() != state {
+			continue
+		}
+		if err := fn(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports progress of probing job ids on stderr, for walks taking longer
+// than a moment. Nothing is reported unless stderr is a terminal.
+type progress struct {
+	s     *server
+	start time.Time
+	last  time.Time
+	shown bool
+}
+
+func newProgress(s *server) *progress {
+	return &progress{s: s, start: time.Now()}
+}
+
+func (p *progress) update(probed uint64, found, expect int) {
+	now := time.Now()
+	if now.Sub(p.start) < time.Second || now.Sub(p.last) < 200*time.Millisecond || !isTerminalFile(os.Stderr) {
+		return
+	}
+	p.last, p.shown = now, true
+
+	fmt.Fprintf(os.Stderr, "\r\033[KScanning %s: %s ids probed, %s of %s jobs found",
+		p.s.addr, formatCount(int(probed)), formatCount(found), formatCount(expect))
+}
+
+// Clears the progress line, if one has been shown.
+func (p *progress) done() {
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
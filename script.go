@@ -0,0 +1,156 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	stopOnError bool // Abort scripts on the first failing command.
+	sourceDepth int  // Nesting level of currently running scripts.
+)
+
+// Maximum nesting level of scripts sourcing other scripts.
+const maxSourceDepth = 10
+
+// Errors of this type are returned when running a script failed.
+type scriptError struct {
+	name string
+	line int // Line number of the failed command, 0 if not known.
+	err  error
+}
+
+func (e scriptError) Error() string {
+	if e.line == 0 {
+		return fmt.Sprintf("%s: %s", e.name, e.err)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.name, e.line, e.err)
+}
+
+// Splits an input line into commands and their arguments. Commands
+// are separated by semicolons, arguments by whitespace. Single or double
+// quotes can be used to include either one in an argument.
+func parseLine(input string) (cmds [][]string, err error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, r := range input {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case r == ';':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			cmds = append(cmds, args)
+			args = nil
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, usageError("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return append(cmds, args), nil
+}
+
+// Executes all commands on an input line in order. Stops at the first
+// failing command.
+func execLine(input string) error {
+	if isAliasDefinition(input) {
+		return defineAlias(input)
+	}
+	cmds, err := parseLine(input)
+	if err != nil {
+		return err
+	}
+	for _, args := range cmds {
+		if len(args) == 0 {
+			continue
+		}
+		if err := run(args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs commands read from r line by line. Empty lines and lines starting
+// with # are skipped. Errors are reported per line, unless stopOnError
+// is enabled, in which case the first error aborts the script.
+func runScript(name string, r io.Reader) error {
+	if sourceDepth >= maxSourceDepth {
+		return scriptError{name, 0, fmt.Errorf("scripts nested too deeply")}
+	}
+	sourceDepth++
+	defer func() { sourceDepth-- }()
+
+	s := bufio.NewScanner(r)
+	n, failed := 0, 0
+
+	for s.Scan() {
+		n++
+		input := strings.TrimSpace(s.Text())
+
+		if input == "" || strings.HasPrefix(input, "#") {
+			continue
+		}
+		err := execLine(input)
+		if err == errQuit {
+			return err
+		}
+		if err == nil {
+			continue
+		}
+		if stopOnError {
+			return scriptError{name, n, err}
+		}
+		printError(scriptError{name, n, err})
+		failed++
+	}
+	if err := s.Err(); err != nil {
+		return scriptError{name, n, err}
+	}
+	if failed > 0 {
+		return scriptError{name, 0, fmt.Errorf("%d commands failed", failed)}
+	}
+	return nil
+}
+
+// Runs commands from given script file.
+func sourceFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return runScript(file, f)
+}
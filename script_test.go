@@ -0,0 +1,35 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatArgsRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"use", "emails", "billing"},
+		{"use", `/^billing\.(eu|us)$/`},
+		{"put", "emails", `{"to": "a@example.org"}`},
+		{"put", "emails", "it's"},
+		{"put", "emails", `both ' and "`},
+		{"put", "emails", "a;b", ""},
+		{"put", "emails", "tab\there"},
+	}
+	for _, args := range tests {
+		line := formatArgs(args)
+
+		cmds, err := parseLine(line)
+		if err != nil {
+			t.Errorf("parseLine(%s) failed: %s", line, err)
+			continue
+		}
+		if len(cmds) != 1 || !reflect.DeepEqual(cmds[0], args) {
+			t.Errorf("parseLine(%s) = %q, want %q", line, cmds, args)
+		}
+	}
+}
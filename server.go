@@ -5,7 +5,193 @@
 
 package main
 
-func stats() {
-	stats, _ := conn.Stats()
-	printStats(stats, nil)
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// A beanstalkd server we are connected to.
+type server struct {
+	addr  string
+	conn  *beanstalk.Conn
+	rconn *textproto.Conn // See rawCmd, opened on first use.
+}
+
+// All servers we are connected to, commands operating on tubes fan out
+// to each of them.
+var servers []*server
+
+// Commands working on given job ids or putting new jobs. Job ids are only
+// unique per server, so these can't work across servers.
+var singleServerCommands = []string{
+	"delete",
+	"inspect",
+	"kick-job",
+	"put",
+	"reprioritize",
+	"restore",
+}
+
+// Returns an error if given command needs a single server, but we are
+// connected to multiple ones.
+func checkSingleServer(args []string) error {
+	if len(servers) > 1 && contains(args[0], singleServerCommands) {
+		var addrs []string
+		for _, s := range servers {
+			addrs = append(addrs, s.addr)
+		}
+		return fmt.Errorf("%s is not possible when connected to multiple servers, connect to one of %s first", args[0], strings.Join(addrs, ", "))
+	}
+	return nil
+}
+
+// Returns the server the given connection belongs to.
+func serverOf(c *beanstalk.Conn) *server {
+	for _, s := range servers {
+		if s.conn == c {
+			return s
+		}
+	}
+	return nil
+}
+
+// Splits a list of comma separated server addresses.
+func splitAddrs(addrs string) (r []string) {
+	for _, a := range strings.Split(addrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+// Shows statistics of each server. When connected to multiple servers,
+// counters are summed up in an additional record.
+func stats() error {
+	var rs []*record
+	var all []map[string]string
+
+	for _, s := range servers {
+		stats, err := s.conn.Stats()
+		if err != nil {
+			return fmt.Errorf("failed to get stats of server %s: %s", s.addr, err)
+		}
+		r := newRecord()
+		if len(servers) > 1 {
+			r.set("server", s.addr)
+		}
+		rs = append(rs, addStats(r, stats, nil))
+		all = append(all, stats)
+	}
+	if len(servers) > 1 {
+		rs = append(rs, addStats(newRecord().set("server", "total"), sumStats(all), nil))
+	}
+	return renderDetail(rs...)
+}
+
+// Sums up counters of multiple sets of statistics. Values which can't be
+// summed up, like the version, are left out.
+func sumStats(all []map[string]string) map[string]string {
+	sum := make(map[string]int)
+
+	for _, stats := range all {
+		for k, v := range stats {
+			if strings.HasPrefix(k, "current-") || strings.HasPrefix(k, "cmd-") ||
+				strings.HasPrefix(k, "total-") || k == "job-timeouts" {
+				sum[k] += castStatsValue(v)
+			}
+		}
+	}
+	r := make(map[string]string, len(sum))
+	for k, v := range sum {
+		r[k] = fmt.Sprint(v)
+	}
+	return r
+}
+
+// Opens connections to given comma separated server addresses, giving up
+// on a server after timeout, if not 0.
+func dial(addrs string, timeout time.Duration) ([]*server, error) {
+	var ss []*server
+
+	for _, a := range splitAddrs(addrs) {
+		rwc, err := dialAddr(a, timeout)
+		if err == nil {
+			// Tunnels only fail once used, make sure we can talk with the
+			// server.
+			c := beanstalk.NewConn(rwc)
+			if _, err = c.ListTubes(); err == nil {
+				ss = append(ss, &server{addr: a, conn: c})
+				continue
+			}
+			c.Close()
+		}
+		for _, s := range ss {
+			s.conn.Close()
+		}
+		return nil, fmt.Errorf("failed to connect to beanstalkd server %s: %s", a, err)
+	}
+	if len(ss) == 0 {
+		return nil, usageError("no server address given")
+	}
+	return ss, nil
+}
+
+// Connects to the servers described by given profile. Replaces any
+// existing connections and selects the profile's default tubes. If it has
+// none, the current selection is kept.
+func connect(p *profile) error {
+	ss, err := dial(p.addr, 0)
+	if err != nil {
+		return err
+	}
+	if servers != nil {
+		disconnect()
+	}
+	servers = ss
+	conn = ss[0].conn // assign to global
+	addr = p.addr
+	cProfile = p
+	disconnected = false
+
+	// Once a profile asked for read-only mode, it stays on for the whole
+	// session. Connecting to the same servers by address, or via another
+	// profile, must not lift it.
+	if p.readonly {
+		readonly = true
+	}
+	cIndex = nil
+
+	switch {
+	case len(p.tubes) > 0:
+		return cTubes.Use(p.tubes)
+	case len(cTubes.Patterns) == 0:
+		return cTubes.UseAll()
+	}
+	return cTubes.Refresh()
+}
+
+// Connects to the servers of given profile or comma separated addresses.
+func connectTo(name string) error {
+	p, ok := profiles[name]
+	if !ok {
+		p = &profile{addr: name}
+	}
+	return connect(p)
+}
+
+// Closes all connections to all servers.
+func disconnect() {
+	for _, s := range servers {
+		s.conn.Close()
+
+		if s.rconn != nil {
+			s.rconn.Close()
+			s.rconn = nil
+		}
+	}
 }
@@ -0,0 +1,335 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// Statistics of all servers and their tubes at a point in time.
+type snapshot struct {
+	Addr    string                     `json:"addr"`
+	TS      time.Time                  `json:"ts"`
+	Servers map[string]*serverSnapshot `json:"servers"` // By address.
+}
+
+type serverSnapshot struct {
+	Stats map[string]string            `json:"stats"`
+	Tubes map[string]map[string]string `json:"tubes"` // By tube name.
+}
+
+func snapshotDir() string {
+	return filepath.Join(stateDir(), "snapshots")
+}
+
+func snapshotFile(name string) string {
+	return filepath.Join(snapshotDir(), name+".json")
+}
+
+// Runs a snapshot subcommand: save, diff, list or delete.
+func snapshotCmd(args []string) error {
+	if len(args) < 1 {
+		return usageError("no subcommand given, must be one of: save, diff, list, delete")
+	}
+	if args[0] == "list" {
+		return listSnapshots()
+	}
+	if len(args) < 2 {
+		return usageError("no snapshot name given")
+	}
+	name := args[1]
+
+	switch args[0] {
+	case "save":
+		if !isValidName(name) || name == "now" {
+			return usageError("invalid snapshot name")
+		}
+		return saveSnapshot(name)
+	case "diff":
+		b := "now"
+		if len(args) > 2 {
+			b = args[2]
+		}
+		return diffSnapshots(name, b)
+	case "delete":
+		if !isValidName(name) {
+			return usageError("invalid snapshot name")
+		}
+		err := os.Remove(snapshotFile(name))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("unknown snapshot %s", name)
+		}
+		return err
+	}
+	return usageError("unknown subcommand, must be one of: save, diff, list, delete")
+}
+
+// Takes statistics of all servers and every tube on them.
+func takeSnapshot() (*snapshot, error) {
+	sn := &snapshot{Addr: addr, TS: time.Now().UTC(), Servers: make(map[string]*serverSnapshot)}
+
+	for _, s := range servers {
+		stats, err := s.conn.Stats()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get stats of server %s: %s", s.addr, err)
+		}
+		ss := &serverSnapshot{Stats: stats, Tubes: make(map[string]map[string]string)}
+
+		tns, err := s.conn.ListTubes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tubes of server %s: %s", s.addr, err)
+		}
+		for _, tn := range tns {
+			t := beanstalk.Tube{Conn: s.conn, Name: tn}
+			stats, err := t.Stats()
+			if isNotFound(err) {
+				// The tube has gone away since listing it.
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to get stats of tube %s: %s", tn, err)
+			}
+			ss.Tubes[tn] = stats
+		}
+		sn.Servers[s.addr] = ss
+	}
+	return sn, nil
+}
+
+// Saves a snapshot under given name. Existing snapshots are not replaced,
+// as they may be needed to investigate an incident.
+func saveSnapshot(name string) error {
+	file := snapshotFile(name)
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("snapshot %s exists already", name)
+	}
+	sn, err := takeSnapshot()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sn, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(snapshotDir(), 0700); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Loads a snapshot by name, now takes a new one.
+func loadSnapshot(name string) (*snapshot, error) {
+	if name == "now" {
+		return takeSnapshot()
+	}
+	if !isValidName(name) {
+		return nil, usageError("invalid snapshot name")
+	}
+	data, err := ioutil.ReadFile(snapshotFile(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("unknown snapshot %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sn := &snapshot{}
+	if err := json.Unmarshal(data, sn); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %s", name, err)
+	}
+	return sn, nil
+}
+
+// Sums up statistics of all servers and of tubes with the same name on
+// different servers.
+func (sn *snapshot) totals() (map[string]string, map[string]map[string]string) {
+	var all []map[string]string
+	byName := make(map[string][]map[string]string)
+
+	for _, ss := range sn.Servers {
+		all = append(all, ss.Stats)
+		for tn, stats := range ss.Tubes {
+			byName[tn] = append(byName[tn], stats)
+		}
+	}
+	tubes := make(map[string]map[string]string, len(byName))
+	for tn, all := range byName {
+		tubes[tn] = sumStats(all)
+	}
+	return sumStats(all), tubes
+}
+
+// Shows how counters of the servers and each tube changed between two
+// snapshots and their rates per second. Anomalies, like growing numbers
+// of buried jobs or jobs not being deleted anymore, are highlighted.
+func diffSnapshots(aName, bName string) error {
+	a, err := loadSnapshot(aName)
+	if err != nil {
+		return err
+	}
+	b, err := loadSnapshot(bName)
+	if err != nil {
+		return err
+	}
+	if a.Addr != b.Addr {
+		return fmt.Errorf("snapshots are of different servers, %s and %s", a.Addr, b.Addr)
+	}
+	if b.TS.Before(a.TS) {
+		a, b = b, a
+	}
+	elapsed := b.TS.Sub(a.TS)
+	aServer, aTubes := a.totals()
+	bServer, bTubes := b.totals()
+
+	var keys []string
+	for k := range bServer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var rs []*record
+	for _, k := range keys {
+		d, rate := sampleDelta(aServer, bServer, elapsed, k)
+
+		var anomaly string
+		switch {
+		case k == "current-jobs-buried" && d > 0:
+			anomaly = "buried growing"
+		case k == "job-timeouts" && d > 0:
+			anomaly = "jobs timing out"
+		case k == "cmd-delete" && d == 0 && castStatsValue(bServer["current-jobs-ready"]) > 0:
+			anomaly = "no deletes"
+		case d == 0:
+			continue
+		}
+		rs = append(rs, newRecord().
+			set("counter", k).
+			set("before", castStatsValue(aServer[k])).
+			set("after", castStatsValue(bServer[k])).
+			set("delta", formatDelta(d)).
+			set("rate/s", fmt.Sprintf("%.1f", rate)).
+			set("anomaly", anomaly))
+	}
+	if format == "text" {
+		fmt.Printf("Changes over %s, from %s to %s.\n\n", elapsed.Round(time.Second),
+			a.TS.Local().Format("2006-01-02 15:04:05"), b.TS.Local().Format("2006-01-02 15:04:05"))
+	}
+	if err := renderHighlighted(rs, isAnomaly); err != nil {
+		return err
+	}
+
+	var names []string
+	for tn := range aTubes {
+		names = append(names, tn)
+	}
+	for tn := range bTubes {
+		if _, ok := aTubes[tn]; !ok {
+			names = append(names, tn)
+		}
+	}
+	sort.Strings(names)
+
+	rs = nil
+	for _, tn := range names {
+		at, bt := aTubes[tn], bTubes[tn]
+		if at == nil {
+			at = make(map[string]string)
+		}
+		if bt == nil {
+			bt = make(map[string]string)
+		}
+		dReady, _ := sampleDelta(at, bt, elapsed, "current-jobs-ready")
+		dBuried, _ := sampleDelta(at, bt, elapsed, "current-jobs-buried")
+		_, put := sampleDelta(at, bt, elapsed, "total-jobs")
+		dDelete, del := sampleDelta(at, bt, elapsed, "cmd-delete")
+
+		var anomalies []string
+		if dBuried > 0 {
+			anomalies = append(anomalies, "buried growing")
+		}
+		if dDelete == 0 && castStatsValue(bt["current-jobs-ready"]) > 0 {
+			anomalies = append(anomalies, "no deletes")
+		}
+		rs = append(rs, newRecord().
+			set("tube", tn).
+			set("ready", castStatsValue(bt["current-jobs-ready"])).
+			set("+ready", formatDelta(dReady)).
+			set("buried", castStatsValue(bt["current-jobs-buried"])).
+			set("+buried", formatDelta(dBuried)).
+			set("delayed", castStatsValue(bt["current-jobs-delayed"])).
+			set("reserved", castStatsValue(bt["current-jobs-reserved"])).
+			set("put/s", fmt.Sprintf("%.1f", put)).
+			set("delete/s", fmt.Sprintf("%.1f", del)).
+			set("anomaly", strings.Join(anomalies, ",")))
+	}
+	return renderHighlighted(rs, isAnomaly)
+}
+
+func isAnomaly(r *record) bool {
+	return r.get("anomaly") != ""
+}
+
+// Returns names of all snapshots starting with prefix, for completion.
+func snapshotNames(prefix string) (r []string) {
+	files, _ := filepath.Glob(filepath.Join(snapshotDir(), "*.json"))
+
+	for _, file := range files {
+		if name := strings.TrimSuffix(filepath.Base(file), ".json"); strings.HasPrefix(name, prefix) {
+			r = append(r, name)
+		}
+	}
+	return r
+}
+
+// Lists saved snapshots, oldest first.
+func listSnapshots() error {
+	files, err := filepath.Glob(filepath.Join(snapshotDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	names := make(map[*snapshot]string, len(files))
+	var sns []*snapshot
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+
+		sn, err := loadSnapshot(name)
+		if err != nil {
+			return err
+		}
+		names[sn] = name
+		sns = append(sns, sn)
+	}
+	sort.Slice(sns, func(i, j int) bool { return sns[i].TS.Before(sns[j].TS) })
+
+	var rs []*record
+	for _, sn := range sns {
+		tubes := make(map[string]bool)
+		for _, ss := range sn.Servers {
+			for tn := range ss.Tubes {
+				tubes[tn] = true
+			}
+		}
+		rs = append(rs, newRecord().
+			set("snapshot", names[sn]).
+			set("ts", sn.TS.Local().Format("2006-01-02 15:04:05")).
+			set("server", sn.Addr).
+			set("tubes", len(tubes)))
+	}
+	return renderTable(rs)
+}
@@ -0,0 +1,48 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Finds jobs in selected tubes that are reserved, but may never be
+// finished by their worker, as well as jobs that have timed out or
+// have been released at least given number of times, which usually
+// points to poison messages. Only jobs at least minAge old are shown.
+func stuckJobs(minAge time.Duration, maxTimeouts, maxReleases int) error {
+	var rs []*record
+
+	err := walkJobs("all", func(j *job) error {
+		if time.Duration(castStatsValue(j.stats["age"]))*time.Second < minAge {
+			return nil
+		}
+		var flags []string
+		if castStatsValue(j.stats["timeouts"]) >= maxTimeouts {
+			flags = append(flags, "timeouts")
+		}
+		if castStatsValue(j.stats["releases"]) >= maxReleases {
+			flags = append(flags, "releases")
+		}
+		if j.state() != "reserved" && len(flags) == 0 {
+			return nil
+		}
+		r := newRecord().set("id", j.id)
+		if len(servers) > 1 {
+			r.set("server", serverOf(j.conn).addr)
+		}
+		r.set("tube", j.tube()).set("state", j.state())
+
+		for _, k := range []string{"age", "time-left", "reserves", "timeouts", "releases"} {
+			r.set(k, castStatsValue(j.stats[k]))
+		}
+		rs = append(rs, r.set("flags", strings.Join(flags, ",")))
+		return nil
+	})
+	renderTable(rs)
+	return err
+}
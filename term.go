@@ -0,0 +1,108 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	stdin    = bufio.NewReader(os.Stdin)
+	ttyState string // Terminal settings to restore, empty if unchanged.
+)
+
+// Runs stty on the terminal connected to stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Checks if given command can read single key presses. For terminals this
+// needs stty, which i.e. Windows lacks.
+func checkKeyInput(cmd string) error {
+	if !isTerminal() {
+		return nil
+	}
+	if _, err := exec.LookPath("stty"); err != nil {
+		return fmt.Errorf("%s is not supported on this platform, as it needs stty", cmd)
+	}
+	return nil
+}
+
+// Switches the terminal into a mode where key presses are available
+// immediately, without waiting for enter, and aren't echoed.
+func rawTerminal() error {
+	s, err := stty("-g")
+	if err != nil {
+		return err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return err
+	}
+	ttyState = s
+	return nil
+}
+
+// Restores terminal settings changed by rawTerminal.
+func restoreTerminal() {
+	if ttyState == "" {
+		return
+	}
+	stty(ttyState)
+	ttyState = ""
+}
+
+// Returns the size of the terminal, 0 if unknown.
+func terminalSize() (rows, cols int) {
+	out, err := stty("size")
+	if err != nil {
+		return 0, 0
+	}
+	fmt.Sscanf(out, "%d %d", &rows, &cols)
+	return rows, cols
+}
+
+// Reads a single key press. Falls back to reading a whole line and using
+// its first character, if stdin isn't a terminal.
+func readKey() (byte, error) {
+	if !isTerminal() {
+		l, err := stdin.ReadString('\n')
+		if l = strings.TrimSpace(l); l != "" {
+			return l[0], nil
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if err := rawTerminal(); err != nil {
+		return 0, err
+	}
+	defer restoreTerminal()
+
+	return stdin.ReadByte()
+}
+
+// Prompts for a line of input, uses liner when in interactive mode.
+func readLine(prompt string) (string, error) {
+	if line != nil {
+		return line.Prompt(prompt)
+	}
+	os.Stdout.WriteString(prompt)
+
+	l, err := stdin.ReadString('\n')
+	if err != nil && l == "" {
+		return "", err
+	}
+	return strings.TrimSpace(l), nil
+}
@@ -0,0 +1,322 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Columns the tube table in top can be sorted by, cycled through by
+// pressing 's'.
+var topSorts = []string{"tube", "ready", "buried", "delayed", "reserved", "put/s", "delete/s"}
+
+// Statistics of the server and selected tubes at a point in time.
+type topSample struct {
+	at     time.Time
+	server map[string]string
+	tubes  map[string]map[string]string
+	names  []string
+}
+
+// Takes a sample of all servers. Statistics of tubes with the same name on
+// different servers are summed up.
+func takeSample() (*topSample, error) {
+	s := &topSample{at: time.Now(), tubes: make(map[string]map[string]string)}
+
+	var all []map[string]string
+	for _, srv := range servers {
+		stats, err := srv.conn.Stats()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get stats of server %s: %s", srv.addr, err)
+		}
+		all = append(all, stats)
+	}
+	s.server = all[0]
+	if len(all) > 1 {
+		s.server = sumStats(all)
+	}
+
+	byName := make(map[string][]map[string]string)
+	for _, t := range cTubes.Conns {
+		stats, err := t.Stats()
+		if isNotFound(err) {
+			// The tube has gone away since we selected it.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		if _, ok := byName[t.Name]; !ok {
+			s.names = append(s.names, t.Name)
+		}
+		byName[t.Name] = append(byName[t.Name], stats)
+	}
+	for name, all := range byName {
+		stats := all[0]
+		if len(all) > 1 {
+			stats = sumStats(all)
+			stats["pause-time-left"] = all[0]["pause-time-left"]
+		}
+		s.tubes[name] = stats
+	}
+	return s, nil
+}
+
+// Returns the change of a counter between two samples and its rate per
+// second. Both are 0 if there is no previous sample.
+func sampleDelta(prev, cur map[string]string, elapsed time.Duration, k string) (int, float64) {
+	if prev == nil || elapsed <= 0 {
+		return 0, 0
+	}
+	d := castStatsValue(cur[k]) - castStatsValue(prev[k])
+	return d, float64(d) / elapsed.Seconds()
+}
+
+// Formats a change with its sign.
+func formatDelta(d int) string {
+	if d > 0 {
+		return fmt.Sprintf("+%d", d)
+	}
+	return strconv.Itoa(d)
+}
+
+// Shows a continuously refreshing table of selected tubes, with changes
+// since the last refresh and rates. Tubes with a growing number of buried
+// jobs are highlighted. Runs until a key other than 's' is pressed or
+// count refreshes have been made, if count is not 0.
+func top(interval time.Duration, sortBy string, count int) error {
+	if !contains(sortBy, topSorts) {
+		return usageError("unknown sort column, must be one of: " + strings.Join(topSorts, ", "))
+	}
+	if err := checkKeyInput("top"); err != nil {
+		return err
+	}
+	var prev *topSample
+
+	return repeat(interval, count, func() error {
+		cur, err := takeSample()
+		if err != nil {
+			return err
+		}
+		drawTop(prev, cur, sortBy)
+		prev = cur
+		return nil
+	}, func(key byte) bool {
+		if key != 's' {
+			return false
+		}
+		for i, s := range topSorts {
+			if s == sortBy {
+				sortBy = topSorts[(i+1)%len(topSorts)]
+				break
+			}
+		}
+		return true
+	})
+}
+
+func drawTop(prev, cur *topSample, sortBy string) {
+	var elapsed time.Duration
+	var prevServer map[string]string
+	if prev != nil {
+		elapsed = cur.at.Sub(prev.at)
+		prevServer = prev.server
+	}
+	var rs []*record
+	growing := make(map[string]bool)
+
+	for _, name := range cur.names {
+		stats := cur.tubes[name]
+		var ps map[string]string
+		if prev != nil {
+			ps = prev.tubes[name]
+		}
+		dReady, _ := sampleDelta(ps, stats, elapsed, "current-jobs-ready")
+		dBuried, _ := sampleDelta(ps, stats, elapsed, "current-jobs-buried")
+		_, put := sampleDelta(ps, stats, elapsed, "total-jobs")
+		_, del := sampleDelta(ps, stats, elapsed, "cmd-delete")
+
+		if dBuried > 0 {
+			growing[name] = true
+		}
+		rs = append(rs, newRecord().
+			set("tube", name).
+			set("ready", castStatsValue(stats["current-jobs-ready"])).
+			set("+ready", formatDelta(dReady)).
+			set("buried", castStatsValue(stats["current-jobs-buried"])).
+			set("+buried", formatDelta(dBuried)).
+			set("delayed", castStatsValue(stats["current-jobs-delayed"])).
+			set("reserved", castStatsValue(stats["current-jobs-reserved"])).
+			set("waiting", castStatsValue(stats["current-waiting"])).
+			set("put/s", fmt.Sprintf("%.1f", put)).
+			set("delete/s", fmt.Sprintf("%.1f", del)).
+			set("paused", castStatsValue(stats["pause-time-left"])))
+	}
+	sort.SliceStable(rs, func(i, j int) bool {
+		if sortBy == "tube" {
+			return rs[i].get("tube").(string) < rs[j].get("tube").(string)
+		}
+		return sortValue(rs[i].get(sortBy)) > sortValue(rs[j].get(sortBy))
+	})
+
+	_, put := sampleDelta(prevServer, cur.server, elapsed, "cmd-put")
+	_, res := sampleDelta(prevServer, cur.server, elapsed, "cmd-reserve")
+	_, del := sampleDelta(prevServer, cur.server, elapsed, "cmd-delete")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s - %s - sorted by %s (press 's' to sort, any other key to quit)\n",
+		addr, cur.at.Format("15:04:05"), sortBy)
+	fmt.Fprintf(&buf, "put/s: %.1f   reserve/s: %.1f   delete/s: %.1f   jobs ready: %s   buried: %s   reserved: %s\n\n",
+		put, res, del, cur.server["current-jobs-ready"], cur.server["current-jobs-buried"], cur.server["current-jobs-reserved"])
+
+	highlightTable(&buf, rs, func(r *record) bool {
+		return growing[r.get("tube").(string)]
+	})
+	drawScreen(buf.String())
+}
+
+// Helper function to compare values of the top table, which are either
+// numbers or formatted rates.
+func sortValue(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
+
+// Clears the screen and draws given content, truncated to the height of
+// the terminal.
+func drawScreen(content string) {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+
+	if rows, _ := terminalSize(); rows > 0 && len(lines) > rows-1 {
+		lines = lines[:rows-1]
+	}
+	fmt.Print("\033[H\033[2J" + strings.Join(lines, "\n") + "\n")
+}
+
+// Repeatedly runs the command on given input line, clearing the screen
+// before each run.
+func watch(interval time.Duration, input string, count int) error {
+	if err := checkKeyInput("watch"); err != nil {
+		return err
+	}
+	return repeat(interval, count, func() error {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "Every %v: %s - %s (press any key to quit)\n\n",
+			interval, input, time.Now().Format("15:04:05"))
+		fmt.Print("\033[H\033[2J" + buf.String())
+
+		if err := execLine(input); err != nil {
+			printError(err)
+		}
+		return nil
+	}, nil)
+}
+
+// Calls draw at given interval and whenever the terminal is resized,
+// until a key is pressed for which key returns false or count calls have
+// been made, if count is not 0. Keys are only read if stdin is a terminal.
+func repeat(interval time.Duration, count int, draw func() error, key func(byte) bool) error {
+	keys := make(chan byte)
+	cont := make(chan bool)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	if isTerminal() {
+		if err := rawTerminal(); err != nil {
+			return err
+		}
+		defer restoreTerminal()
+
+		// Let reads time out after a tenth of a second, so the reader
+		// notices when we are done and doesn't take input meant for the
+		// prompt.
+		if _, err := stty("min", "0", "time", "1"); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				b, err := stdin.ReadByte()
+				if err == io.EOF {
+					// Timed out without a key press.
+					continue
+				}
+				if err != nil {
+					close(keys)
+					return
+				}
+				select {
+				case keys <- b:
+				case <-stop:
+					return
+				}
+				// Stop reading once we are told to, so no input is lost
+				// when returning to the prompt.
+				if !<-cont {
+					return
+				}
+			}
+		}()
+	}
+	// Runs before the terminal is restored, stdin must not be read
+	// anymore once we return.
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	resize := make(chan os.Signal, 1)
+	notifyResize(resize)
+	defer signal.Stop(resize)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; count == 0 || i < count; i++ {
+		if err := draw(); err != nil {
+			return err
+		}
+		if count != 0 && i == count-1 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-resize:
+		case b, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			c := key != nil && key(b)
+			cont <- c
+			if !c {
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Opens a connection to a server address, which is either host:port, a
+// unix socket as unix:///run/beanstalkd.sock or a server reachable
+// through SSH as ssh://user@host/127.0.0.1:11300. A timeout of 0 means no
+// timeout, for SSH it limits establishing the SSH connection.
+func dialAddr(addr string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	if !strings.Contains(addr, "://") && !strings.HasPrefix(addr, "unix:") {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, usageError(fmt.Sprintf("invalid address %s: %s", addr, err))
+	}
+	switch u.Scheme {
+	case "tcp":
+		return net.DialTimeout("tcp", u.Host, timeout)
+	case "unix":
+		return net.DialTimeout("unix", u.Path, timeout)
+	case "ssh":
+		return dialSSH(u, timeout)
+	}
+	return nil, usageError(fmt.Sprintf("unsupported address scheme %s", u.Scheme))
+}
+
+// A connection tunneled through the standard input and output of the
+// local ssh binary.
+type sshConn struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.WriteCloser
+}
+
+// Starts ssh, asking it to forward its standard input and output to the
+// server address given as the URL's path. The address defaults to the
+// default address of beanstalkd on the remote host. ssh prompts for
+// passwords itself and reports errors on our standard error.
+func dialSSH(u *url.URL, timeout time.Duration) (io.ReadWriteCloser, error) {
+	target := strings.TrimPrefix(u.Path, "/")
+	if target == "" {
+		target = defaultAddr
+	}
+	args := []string{"-W", target}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	if timeout > 0 {
+		// ssh takes whole seconds only.
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d", int((timeout+time.Second-1)/time.Second)))
+	}
+	dest := u.Hostname()
+	if u.User != nil {
+		dest = u.User.Username() + "@" + dest
+	}
+	cmd := exec.Command("ssh", append(args, dest)...)
+	cmd.Stderr = os.Stderr
+
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh: %s", err)
+	}
+	return &sshConn{cmd, r, w}, nil
+}
+
+// Closes the tunnel and waits for ssh to exit.
+func (c *sshConn) Close() error {
+	c.WriteCloser.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
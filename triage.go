@@ -0,0 +1,181 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// Actions available in triage mode, in the order they are shown.
+var triageActions = []string{"kick", "delete", "skip", "edit", "move", "write", "quit"}
+
+// Walks over jobs in given state in selected tubes, shows each job and
+// lets the user act on it with a single key press. As only the head of
+// each queue can be peeked into, we move on to the next tube once the
+// head is a job the user skipped.
+func triage(state string) error {
+	if !contains(state, states) {
+		return usageError("unknown state")
+	}
+	if err := checkKeyInput("triage"); err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+
+	for _, t := range cTubes.Conns {
+		seen := make(map[uint64]bool)
+
+		for {
+			id, _, err := peekState(t, state)
+			if isNotFound(err) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+			}
+			if seen[id] {
+				fmt.Printf("No more %s jobs in tube %s, except skipped ones.\n\n", state, t.Name)
+				break
+			}
+			j, err := fetchJob(t.Conn, id)
+			if isNotFound(err) {
+				// The job has been removed in the meantime, continue with the next one.
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to fetch job %d: %s", id, err)
+			}
+			if err := printJob(j.id, j.body, j.stats); err != nil {
+				return err
+			}
+			action, nid, err := triageJob(j)
+			if action == "quit" {
+				if rerr := renderTable(triageSummary(counts)); err == nil {
+					err = rerr
+				}
+				return err
+			}
+			if err != nil {
+				printError(err)
+				seen[id] = true
+				continue
+			}
+			counts[action]++
+
+			if action == "skip" {
+				seen[id] = true
+			}
+			if nid != 0 {
+				seen[nid] = true
+			}
+			fmt.Println()
+		}
+	}
+	return renderTable(triageSummary(counts))
+}
+
+// Asks the user for an action and runs it on the job. Returns the action
+// run and the id of the new job, if the job was requeued. Quits once input
+// ends, or with an error if keys can't be read.
+func triageJob(j *job) (action string, nid uint64, err error) {
+	for {
+		fmt.Print("(k)ick, (d)elete, (s)kip, (e)dit, (m)ove, (w)rite or (q)uit? ")
+
+		key, err := readKey()
+		if err != nil {
+			fmt.Println()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return "quit", 0, nil
+			}
+			return "quit", 0, fmt.Errorf("failed to read key: %s", err)
+		}
+		for _, a := range triageActions {
+			if a[0] == key {
+				action = a
+			}
+		}
+		if action != "" {
+			fmt.Println(action)
+			break
+		}
+		fmt.Println()
+	}
+
+	switch action {
+	case "kick":
+		if err = kickJob(j.conn, j.id); err == nil {
+			auditJob("kicked", j.conn, j.id, j.tube(), j.body)
+		}
+	case "delete":
+		if err = j.conn.Delete(j.id); err == nil {
+			auditJob("deleted", j.conn, j.id, j.tube(), j.body)
+		}
+	case "edit":
+		body, eerr := editBody(j.body)
+		if eerr != nil {
+			return action, 0, eerr
+		}
+		nid, err = replaceJob(j, j.tube(), body, j.pri())
+	case "move":
+		tube, lerr := readLine("Move to tube: ")
+		if lerr != nil || tube == "" {
+			return action, 0, usageError("no tube given")
+		}
+		nid, err = replaceJob(j, tube, j.body, j.pri())
+	case "write":
+		file, lerr := readLine("Write body to file: ")
+		if lerr != nil || file == "" {
+			return action, 0, usageError("no file given")
+		}
+		err = ioutil.WriteFile(file, j.body, 0644)
+	}
+	if err != nil && (action == "kick" || action == "delete") {
+		err = fmt.Errorf("job %d: %s", j.id, jobFailure(j.conn, j.id, err))
+	}
+	return action, nid, err
+}
+
+// Opens the body in the user's editor and returns the edited body.
+func editBody(body []byte) ([]byte, error) {
+	f, err := ioutil.TempFile("", "bsa-job-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Close()
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command(editor, f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor failed: %s", err)
+	}
+	return ioutil.ReadFile(f.Name())
+}
+
+// Creates records counting how often each action was taken.
+func triageSummary(counts map[string]int) (rs []*record) {
+	for _, a := range triageActions {
+		if a == "quit" {
+			continue
+		}
+		rs = append(rs, newRecord().set("action", a).set("jobs", counts[a]))
+	}
+	return rs
+}
@@ -6,7 +6,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
@@ -14,102 +16,589 @@ import (
 )
 
 type Tubes struct {
-	Names []string
-	Conns []beanstalk.Tube
-	All   bool // Flag indicating if all available tubes are represented.
+	Patterns []string    // Selection as given to Use.
+	Filter   []condition // Conditions on statistics selected tubes must meet.
+	Names    []string
+	Conns    []beanstalk.Tube // One per tube and server, ordered by tube.
+	All      bool             // Flag indicating if all available tubes are represented.
 }
 
-func (ts *Tubes) Reset() {
-	ts.Conns = ts.Conns[:0]
-	ts.Names = ts.Names[:0]
+// Selects tubes by patterns. A pattern is either a tube name, a glob like
+// mail-*, a regular expression enclosed in slashes like /^billing\./ or
+// any of these prefixed with ! to exclude matching tubes. If all patterns
+// are prefixed with + or -, they are added to or removed from the current
+// selection instead of replacing it. Patterns may be followed by a filter
+// on tube statistics, i.e. "where buried>0 and ready>1000".
+func (ts *Tubes) Use(patterns []string) error {
+	var filter []condition
+	where := false
+
+	for i, p := range patterns {
+		if p != "where" {
+			continue
+		}
+		cs, err := parseFilter(strings.Join(patterns[i+1:], " "))
+		if err != nil {
+			return err
+		}
+		filter, patterns, where = cs, patterns[:i], true
+		break
+	}
+	var ps []string
+
+	switch {
+	case where && len(patterns) == 0:
+		// Just a filter, keep the current patterns or select all.
+		ps = ts.Patterns
+		if len(ps) == 0 {
+			ps = []string{"*"}
+		}
+	case !where && isModification(patterns):
+		filter = ts.Filter
+		fallthrough
+	default:
+		var err error
+		if ps, err = combinePatterns(ts.Patterns, patterns); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range ps {
+		if _, err := compilePattern(strings.TrimPrefix(p, "!")); err != nil {
+			return usageError(fmt.Sprintf("invalid pattern %s: %s", p, err))
+		}
+	}
+	ts.Patterns, ts.Filter = ps, filter
+	return ts.Refresh()
 }
 
-// Selects tubes.
-func (ts *Tubes) Use(tns []string) {
-	ts.Reset()
-	ts.All = false
+// Selects all tubes existing on any server.
+func (ts *Tubes) UseAll() error {
+	return ts.Use([]string{"*"})
+}
 
-	for _, tn := range tns {
-		ts.Conns = append(ts.Conns, beanstalk.Tube{conn, tn})
-		ts.Names = append(ts.Names, tn)
+// Checks if the selection depends on which tubes exist, so it must be
+// refreshed once in a while.
+func (ts *Tubes) Dynamic() bool {
+	if len(ts.Filter) > 0 {
+		return true
 	}
-	return
+	for _, p := range ts.Patterns {
+		if !isTubeName(strings.TrimPrefix(p, "!")) {
+			return true
+		}
+	}
+	return false
 }
 
-func (ts *Tubes) UseAll() {
-	ts.Reset()
-	ts.All = true
+// Evaluates the patterns of the selection against the tubes currently
+// existing on each server. Tubes given by name are selected on every
+// server, even if they don't exist yet, tubes matching patterns only on
+// the servers they exist on.
+func (ts *Tubes) Refresh() error {
+	exist := make(map[*server][]string)
+	var all []string
+
+	if ts.Dynamic() {
+		for _, s := range servers {
+			tns, err := s.conn.ListTubes()
+			if err != nil {
+				return fmt.Errorf("failed to list tubes of server %s: %s", s.addr, err)
+			}
+			exist[s] = tns
+
+			for _, tn := range tns {
+				if !contains(tn, all) {
+					all = append(all, tn)
+				}
+			}
+		}
+	}
+	var names, literals []string
+
+	for _, p := range ts.Patterns {
+		if strings.HasPrefix(p, "!") {
+			continue
+		}
+		if isTubeName(p) {
+			literals = append(literals, p)
+			if !contains(p, names) {
+				names = append(names, p)
+			}
+			continue
+		}
+		re, _ := compilePattern(p)
+		for _, tn := range all {
+			if re.MatchString(tn) && !contains(tn, names) {
+				names = append(names, tn)
+			}
+		}
+	}
+	for _, p := range ts.Patterns {
+		if !strings.HasPrefix(p, "!") {
+			continue
+		}
+		re, _ := compilePattern(p[1:])
+		var kept []string
+		for _, tn := range names {
+			if !re.MatchString(tn) {
+				kept = append(kept, tn)
+			}
+		}
+		names = kept
+	}
 
-	tns, _ := conn.ListTubes()
-	for _, tn := range tns {
-		ts.Conns = append(ts.Conns, beanstalk.Tube{conn, tn})
-		ts.Names = append(ts.Names, tn)
+	ts.Names = names
+	ts.Conns = nil
+	ts.All = len(ts.Patterns) == 1 && ts.Patterns[0] == "*" && len(ts.Filter) == 0
+
+	for _, tn := range names {
+		for _, s := range servers {
+			if contains(tn, literals) || contains(tn, exist[s]) {
+				ts.Conns = append(ts.Conns, beanstalk.Tube{Conn: s.conn, Name: tn})
+			}
+		}
 	}
-	return
+	return ts.applyFilter()
 }
 
-// Prints most important statistics for each tube.
-func listTubes() {
-	lf := "%20s %10s %30s %30s\n"
+// Describes the selection, as shown in the prompt.
+func (ts *Tubes) String() string {
+	if ts.All {
+		return "*"
+	}
+	s := strings.Join(ts.Patterns, ", ")
+	if len(ts.Filter) > 0 {
+		s += " where " + formatFilter(ts.Filter)
+	}
+	return s
+}
 
-	fmt.Printf(lf, "", "paused", "ready/delayed/buried", "waiting/watching/using")
-	fmt.Println(strings.Repeat("-", 93))
+// Combines patterns given to use with the current ones. Patterns
+// prefixed with + or - modify the current ones, any other pattern starts
+// a new selection. Exclusions alone exclude tubes from all tubes. Removing
+// the last tube from the selection is an error, so we never end up
+// selecting all tubes by accident.
+func combinePatterns(current, patterns []string) ([]string, error) {
+	var ps []string
 
-	for _, t := range cTubes.Conns {
-		var pf, wf, jf string
-		stats, _ := t.Stats()
-
-		if stats["pause"] == "0" {
-			pf = "-"
-		} else {
-			pf = fmt.Sprintf("%ss", stats["pause-time-left"])
-		}
-		jf = fmt.Sprintf(
-			"%d (%d) / %d / %d",
-			castStatsValue(stats["current-jobs-ready"]),
-			castStatsValue(stats["current-jobs-urgent"]),
-			castStatsValue(stats["current-jobs-delayed"]),
-			castStatsValue(stats["current-jobs-buried"]),
-		)
-		wf = fmt.Sprintf(
-			"%d / %d / %d",
-			castStatsValue(stats["current-waiting"]),
-			castStatsValue(stats["current-watching"]),
-			castStatsValue(stats["current-using"]),
-		)
-		fmt.Printf(lf, t.Name, pf, jf, wf)
-	}
-	fmt.Println()
-}
-
-func kickTubes(bound int) {
-	for _, t := range cTubes.Conns {
-		t.Kick(bound)
-		fmt.Printf("Kicked jobs in tube %s.\n", t.Name)
+	modify := isModification(patterns)
+	if modify {
+		ps = append(ps, current...)
+	}
+	for _, p := range patterns {
+		switch {
+		case strings.HasPrefix(p, "+"):
+			ps = removePattern(ps, "!"+p[1:])
+			if !contains(p[1:], ps) {
+				ps = append(ps, p[1:])
+			}
+		case strings.HasPrefix(p, "-"):
+			if contains(p[1:], ps) {
+				ps = removePattern(ps, p[1:])
+			} else {
+				ps = append(ps, "!"+p[1:])
+			}
+		default:
+			ps = append(ps, p)
+		}
+	}
+	for _, p := range ps {
+		if !strings.HasPrefix(p, "!") {
+			return ps, nil
+		}
+	}
+	if modify {
+		return nil, usageError("no tubes left in selection")
 	}
+	return append([]string{"*"}, ps...), nil
 }
 
-func pauseTubes(delay time.Duration) {
-	for _, t := range cTubes.Conns {
-		t.Pause(delay)
-		fmt.Printf("Paused tube %s for %v.\n", t.Name, delay)
+// Checks if all patterns modify the current selection.
+func isModification(patterns []string) bool {
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "+") && !strings.HasPrefix(p, "-") {
+			return false
+		}
 	}
+	return len(patterns) > 0
 }
 
-func clearTubes(state string) {
-	cnt := 0
+func removePattern(ps []string, p string) []string {
+	var r []string
+	for _, v := range ps {
+		if v != p {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// Checks if a pattern is a plain tube name.
+func isTubeName(p string) bool {
+	return !strings.ContainsAny(p, "*?") && !(len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/"))
+}
+
+// Compiles a tube name, glob or regular expression enclosed in slashes
+// into a regular expression.
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		return regexp.Compile(p[1 : len(p)-1])
+	}
+	re := regexp.QuoteMeta(p)
+	re = strings.Replace(re, `\*`, ".*", -1)
+	re = strings.Replace(re, `\?`, ".", -1)
+	return regexp.Compile("^" + re + "$")
+}
+
+// Creates a record for a tube, includes the server when connected to
+// multiple servers.
+func newTubeRecord(t beanstalk.Tube) *record {
+	r := newRecord()
+	if len(servers) > 1 {
+		r.set("server", serverOf(t.Conn).addr)
+	}
+	return r.set("tube", t.Name)
+}
+
+// Shows most important statistics for each tube. When connected to
+// multiple servers, each tube is followed by its totals across servers.
+// Tubes missing on some servers are skipped there.
+func listTubes() error {
+	var rs []*record
+	var group []map[string]string
+
+	for i, t := range cTubes.Conns {
+		stats, err := t.Stats()
+		if isNotFound(err) && len(servers) > 1 {
+			stats = nil
+		} else if err != nil {
+			return fmt.Errorf("failed to get stats of tube %s: %s", t.Name, err)
+		}
+		if stats != nil {
+			rs = append(rs, tubeRecord(newTubeRecord(t), stats))
+			group = append(group, stats)
+		}
+
+		last := i == len(cTubes.Conns)-1 || cTubes.Conns[i+1].Name != t.Name
+		if last && len(servers) > 1 && len(group) > 0 {
+			r := newRecord().set("server", "total").set("tube", t.Name)
+			rs = append(rs, tubeRecord(r, sumStats(group)))
+		}
+		if last {
+			group = group[:0]
+		}
+	}
+	return renderTable(rs)
+}
+
+// Adds statistics of a tube to its record.
+func tubeRecord(r *record, stats map[string]string) *record {
+	return r.
+		set("paused", castStatsValue(stats["pause-time-left"])).
+		set("ready", castStatsValue(stats["current-jobs-ready"])).
+		set("urgent", castStatsValue(stats["current-jobs-urgent"])).
+		set("delayed", castStatsValue(stats["current-jobs-delayed"])).
+		set("buried", castStatsValue(stats["current-jobs-buried"])).
+		set("waiting", castStatsValue(stats["current-waiting"])).
+		set("watching", castStatsValue(stats["current-watching"])).
+		set("using", castStatsValue(stats["current-using"]))
+}
+
+// Runs an operation on each selected tube, which adds its outcome to the
+// tube's record. Failures are recorded and don't stop the operation on
+// other tubes and servers. Returns an error if the operation failed for
+// any tube.
+func eachTube(op func(t beanstalk.Tube, r *record) error) error {
+	var rs []*record
+	var errs []error
 
 	for _, t := range cTubes.Conns {
+		r := newTubeRecord(t)
+
+		if err := op(t, r); err != nil {
+			r.set("error", err.Error())
+			errs = append(errs, err)
+		}
+		rs = append(rs, r)
+	}
+	if err := renderTable(rs); err != nil {
+		return err
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return fmt.Errorf("failed for %d of %d tubes", len(errs), len(rs))
+}
+
+func kickTubes(bound int) error {
+	if err := confirmKick(bound); err != nil {
+		return err
+	}
+	// Jobs are kicked one by one, so we know which jobs have been kicked.
+	// Like the server, we kick buried jobs or delayed ones if there are no
+	// buried jobs.
+	return eachTube(func(t beanstalk.Tube, r *record) error {
+		state := "buried"
+		if _, _, err := t.PeekBuried(); isNotFound(err) {
+			state = "delayed"
+		} else if err != nil {
+			return fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+		}
+		cnt := 0
+
+		for cnt < bound {
+			id, body, err := peekState(t, state)
+			if isNotFound(err) {
+				break
+			}
+			if err != nil {
+				r.set("kicked", cnt)
+				return fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+			}
+			if err := kickJob(t.Conn, id); isNotFound(err) {
+				// The job has been deleted or reserved in the meantime.
+				continue
+			} else if err != nil {
+				r.set("kicked", cnt)
+				return fmt.Errorf("failed to kick job %v: %s", id, err)
+			}
+			auditJob("kicked", t.Conn, id, t.Name, body)
+			cnt++
+		}
+		r.set("kicked", cnt)
+		return nil
+	})
+}
+
+func pauseTubes(delay time.Duration) error {
+	return eachTube(func(t beanstalk.Tube, r *record) error {
+		if err := t.Pause(delay); err != nil {
+			return fmt.Errorf("failed to pause tube %s: %s", t.Name, err)
+		}
+		auditTube(t.Name)
+		r.set("paused", int(delay.Seconds()))
+		return nil
+	})
+}
+
+func clearTubes(state string) error {
+	if !contains(state, states) {
+		return usageError("unknown state")
+	}
+	if err := confirmState("delete", state, 0, ""); err != nil {
+		return err
+	}
+	return eachTube(func(t beanstalk.Tube, r *record) error {
+		cnt := 0
+		r.set("state", state)
+
 		for {
-			if id, _, err := peekState(t, state); err == nil {
-				if err := conn.Delete(id); err != nil {
-					panic(fmt.Sprintf("Failed deleting job %v.\n", id))
+			id, body, err := peekState(t, state)
+			if isNotFound(err) {
+				break
+			}
+			if err != nil {
+				r.set("deleted", cnt)
+				return fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+			}
+			if err := t.Conn.Delete(id); err != nil {
+				r.set("deleted", cnt)
+				return fmt.Errorf("failed deleting job %v: %s", id, err)
+			}
+			auditJob("deleted", t.Conn, id, t.Name, body)
+			cnt++
+		}
+		r.set("deleted", cnt)
+		return nil
+	})
+}
+
+// Used to stop walking over jobs early.
+var errStop = errors.New("stop")
+
+// Moves jobs in given state from selected tubes into another tube, at most
+// limit jobs if limit is not 0. Jobs keep their priority, TTR and remaining
+// delay, but get new ids. Ready jobs are reserved while being moved, so
+// workers can't take them in the meantime. Jobs in other states which a
+// worker reserves while being moved are left alone. On failure, shows what
+// has been moved so far.
+func moveJobs(state, dest string, limit int) error {
+	if !contains(state, states) {
+		return usageError("unknown state")
+	}
+	if err := confirmState("move", state, limit, dest); err != nil {
+		return err
+	}
+	// Connections of our own, used to reserve ready jobs. Each server gets
+	// one when first needed.
+	rconns := make(map[*server]*beanstalk.Conn)
+	defer func() {
+		for _, c := range rconns {
+			c.Close()
+		}
+	}()
+
+	var rs []*record
+	total := 0
+
+	for _, t := range cTubes.Conns {
+		if t.Name == dest {
+			continue
+		}
+		moved, skipped := 0, 0
+		var last uint64
+		var err error
+
+		var rc *beanstalk.Conn
+		if state == "ready" {
+			s := serverOf(t.Conn)
+			if rc = rconns[s]; rc == nil {
+				rwc, derr := dialAddr(s.addr, 0)
+				if derr != nil {
+					renderTable(rs)
+					return fmt.Errorf("failed to connect to beanstalkd server %s: %s", s.addr, derr)
 				}
-				cnt++
+				rc = beanstalk.NewConn(rwc)
+				rconns[s] = rc
+			}
+		}
+
+		for limit == 0 || total < limit {
+			var result string
+			if rc != nil {
+				result, err = moveReserved(rc, t, dest)
 			} else {
+				result, err = moveHead(t, state, dest, &last)
+			}
+			if err != nil || result == "" {
 				break
 			}
+			if result == "skipped" {
+				skipped++
+				continue
+			}
+			moved++
+			total++
+		}
+		rs = append(rs, newTubeRecord(t).set("dest", dest).set("moved", moved).set("skipped", skipped))
+
+		if err != nil {
+			renderTable(rs)
+			return err
+		}
+	}
+	return renderTable(rs)
+}
+
+// Reserves the next ready job of a tube on given connection and moves it
+// into another tube. Returns "moved", or an empty result if there are no
+// more ready jobs. If the copy can't be put, the job is released again.
+func moveReserved(rc *beanstalk.Conn, t beanstalk.Tube, dest string) (string, error) {
+	ts := beanstalk.NewTubeSet(rc, t.Name)
+
+	id, body, err := ts.Reserve(0)
+	if isTimeout(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to reserve job in tube %s: %s", t.Name, err)
+	}
+	stats, err := rc.StatsJob(id)
+	if err != nil {
+		// The server releases the job once we close the connection.
+		return "", fmt.Errorf("failed to get stats of job %d: %s", id, err)
+	}
+	// The copy is put over the connection of the tube, so it is recorded
+	// with the right server.
+	j := &job{t.Conn, id, body, stats}
+
+	if _, err := copyJob(j, dest, body, j.pri()); err != nil {
+		if rerr := rc.Release(id, j.pri(), 0); rerr != nil {
+			return "", fmt.Errorf("failed to move job %d: failed to put copy: %s, failed to release job: %s", id, err, rerr)
+		}
+		return "", fmt.Errorf("failed to move job %d: failed to put copy: %s", id, err)
+	}
+	if err := rc.Delete(id); err != nil {
+		return "", fmt.Errorf("job %d has been copied but not deleted: %s", id, err)
+	}
+	auditJob("deleted", t.Conn, id, t.Name, body)
+	return "moved", nil
+}
+
+// Moves the head job in given state of a tube into another tube. Returns
+// "moved", "skipped" if a worker reserved or deleted the job in the
+// meantime, or an empty result if there are no more such jobs. last holds
+// the id of the previous head job, to detect jobs we fail to move.
+func moveHead(t beanstalk.Tube, state, dest string, last *uint64) (string, error) {
+	id, _, err := peekState(t, state)
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to peek into tube %s: %s", t.Name, err)
+	}
+	if id == *last {
+		return "", fmt.Errorf("failed to move job %d, it is still in tube %s", id, t.Name)
+	}
+	*last = id
+
+	j, err := fetchJob(t.Conn, id)
+	if isNotFound(err) {
+		return "skipped", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch job %d: %s", id, err)
+	}
+	nid, err := replaceJob(j, dest, j.body, j.pri())
+	if err == nil {
+		return "moved", nil
+	}
+	// A copy left behind means the job exists twice now, which must not
+	// go unnoticed.
+	if nid != 0 {
+		return "", fmt.Errorf("failed to move job %d, copy left behind in tube %s: %s", id, dest, err)
+	}
+	if stats, serr := t.Conn.StatsJob(id); isNotFound(serr) || (serr == nil && stats["state"] == "reserved") {
+		return "skipped", nil
+	}
+	return "", fmt.Errorf("failed to move job %d: %s", id, err)
+}
+
+// Copies jobs in given state from selected tubes into another tube, at most
+// limit jobs if limit is not 0. Copies keep priority, TTR and remaining
+// delay of the original jobs.
+func copyJobs(state, dest string, limit int) error {
+	counts := make(map[string]int)
+	total := 0
+
+	err := walkJobs(state, func(j *job) error {
+		if limit != 0 && total >= limit {
+			return errStop
+		}
+		if j.tube() == dest {
+			return nil
+		}
+		if _, err := copyJob(j, dest, j.body, j.pri()); err != nil {
+			return fmt.Errorf("failed to copy job %d: %s", j.id, err)
+		}
+		counts[j.tube()]++
+		total++
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+
+	var rs []*record
+	for _, tn := range cTubes.Names {
+		if tn != dest {
+			rs = append(rs, newRecord().set("tube", tn).set("dest", dest).set("copied", counts[tn]))
 		}
-		fmt.Printf("Tube %s cleared, %d %s jobs deleted.\n", t.Name, cnt, state)
 	}
+	renderTable(rs)
+	return err
 }
@@ -6,16 +6,24 @@
 package main
 
 import (
-	"fmt"
+	"flag"
+	"io/ioutil"
+	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kr/beanstalk"
+	"github.com/peterh/liner"
 )
 
-// Helper function to print statistics. Can use whitelist
-// if provided. Otherwise will print all keys.
-func printStats(data map[string]string, whitelist []string) {
+// Job states that can be peeked into.
+var states = []string{"ready", "delayed", "buried"}
+
+// Helper function to add statistics to a record. Can use whitelist
+// if provided. Otherwise will add all keys.
+func addStats(r *record, data map[string]string, whitelist []string) *record {
 	keys := make([]string, 0, len(data))
 	for k := range data {
 		if whitelist == nil || contains(k, whitelist) {
@@ -25,8 +33,9 @@ func printStats(data map[string]string, whitelist []string) {
 	sort.Strings(keys)
 
 	for i := range keys {
-		fmt.Printf("%25s: %s\n", keys[i], data[keys[i]])
+		r.set(keys[i], parseStatsValue(data[keys[i]]))
 	}
+	return r
 }
 
 // Helper function to convert integers from
@@ -36,6 +45,18 @@ func castStatsValue(v string) int {
 	return int(r)
 }
 
+// Helper function to convert values as returned by stats commands
+// into numbers where possible, so they are typed in structured output.
+func parseStatsValue(v string) interface{} {
+	if r, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return r
+	}
+	if r, err := strconv.ParseFloat(v, 64); err == nil {
+		return r
+	}
+	return v
+}
+
 // Helper function to check if a given string is contained in an slice of
 // strings.
 func contains(n string, h []string) bool {
@@ -47,6 +68,114 @@ func contains(n string, h []string) bool {
 	return false
 }
 
+// Helper function to parse durations. Plain numbers are interpreted as
+// seconds, otherwise any duration string like 1m30s is accepted.
+func parseDuration(v string) (time.Duration, error) {
+	if r, err := strconv.ParseUint(v, 0, 0); err == nil {
+		return time.Duration(r) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, usageError("not a valid duration: " + v)
+	}
+	return d, nil
+}
+
+// Flag value for durations, see parseDuration.
+type durationValue time.Duration
+
+func (d *durationValue) Set(v string) error {
+	r, err := parseDuration(v)
+	*d = durationValue(r)
+	return err
+}
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+// Helper function to parse flags given to a command. Flags must precede
+// other arguments, parse errors are reported as usage errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(ioutil.Discard)
+
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	return nil
+}
+
+// Maximum number of jobs an id range may span, guards against typos.
+const maxIDRange = 100000
+
+// Helper function to parse job ids. Each argument is either a single id
+// or a range of ids, i.e. 100-250.
+func parseIDs(args []string) (ids []uint64, err error) {
+	for _, arg := range args {
+		lo, hi := arg, arg
+		if i := strings.Index(arg, "-"); i > 0 {
+			lo, hi = arg[:i], arg[i+1:]
+		}
+		l, lerr := strconv.ParseUint(lo, 10, 64)
+		h, herr := strconv.ParseUint(hi, 10, 64)
+		if lerr != nil || herr != nil || l == 0 || l > h {
+			return nil, usageError("not a valid job id or range: " + arg)
+		}
+		if h-l >= maxIDRange {
+			return nil, usageError("job id range too large: " + arg)
+		}
+		for id := l; id <= h; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Helper function to parse flags given to a command, like parseFlags,
+// but flags may also follow other arguments. Returns the other arguments.
+func parseInterspersedFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return rest, nil
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// Helper function to check if stdin is a terminal.
+func isTerminal() bool {
+	_, err := liner.TerminalMode()
+	return err == nil
+}
+
+// Helper function to check if given file, i.e. stdout, is a terminal.
+func isTerminalFile(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Helper function to check if the server responded with NOT_FOUND.
+func isNotFound(err error) bool {
+	if cerr, ok := err.(beanstalk.ConnError); ok {
+		err = cerr.Err
+	}
+	return err == beanstalk.ErrNotFound
+}
+
+// Helper function to check if a reserve timed out.
+func isTimeout(err error) bool {
+	if cerr, ok := err.(beanstalk.ConnError); ok {
+		err = cerr.Err
+	}
+	return err == beanstalk.ErrTimeout
+}
+
 func peekState(t beanstalk.Tube, state string) (id uint64, body []byte, err error) {
 	switch state {
 	case "ready":
@@ -56,5 +185,5 @@ func peekState(t beanstalk.Tube, state string) (id uint64, body []byte, err erro
 	case "buried":
 		return t.PeekBuried()
 	}
-	return
+	return 0, nil, usageError("unknown state")
 }
@@ -0,0 +1,13 @@
+// Copyright 2014 David Persson. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+)
+
+// Resize notifications are not available on Windows.
+func notifyResize(c chan os.Signal) {}